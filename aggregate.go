@@ -0,0 +1,301 @@
+package pgcache
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/google/btree"
+)
+
+// Aggregate keeps the count, sums, mins and maxs of table rows by group, which are updated
+// incrementally as the rows change, so they're got without scanning the rows. The rows are grouped
+// by the "MapKeys" fields, which compose K as the keys of a map do. A row saved twice is counted
+// twice, so the table must keep its rows by "PrimaryKeys" to dedupe the changes. Use Aggregate.Data
+// as an element of Table.Datas to keep it up to date, for example:
+//
+//	stocks := pgcache.NewAggregate[string](
+//		pgcache.Data{MapKeys: []string{"Warehouse"}}, pgcache.AggregateOptions{Sum: []string{"Stock"}},
+//	)
+//	dbCache.Add(&pgcache.Table{
+//		Name: "stocks", RowStruct: Stock{}, Datas: []*pgcache.Data{stocks.Data()},
+//	})
+//	totals, ok := stocks.Get("north")
+type Aggregate[K comparable] struct {
+	mutex   sync.RWMutex
+	groups  map[K]*aggregateGroup
+	options AggregateOptions
+	data    *Data
+	// the fields of Min and Max, and the functions to compare them.
+	extremeFields []string
+	extremeCmps   []func(a, b reflect.Value) int
+	// a placeholder for Data.DataPtr, it's never filled.
+	placeholder map[K]interface{}
+}
+
+// AggregateOptions describes the aggregate functions of each group. The rows are always counted.
+type AggregateOptions struct {
+	// The integer or float fields to sum. The sum of integers is exact, but the sum of floats may
+	// accumulate rounding errors as rows are added and removed.
+	Sum []string
+	// The fields to get the min or max value, which should be integers, floats, strings,
+	// time.Time, or structs of them. The distinct values of a group are kept in a B-tree with their
+	// counts, so the next extreme is got when the current one is removed.
+	Min []string
+	Max []string
+}
+
+// Totals is the aggregated result of a group.
+type Totals struct {
+	Count int
+	// the sums by field.
+	Sum map[string]float64
+	// the min and max values by field.
+	Min map[string]interface{}
+	Max map[string]interface{}
+}
+
+type aggregateGroup struct {
+	count     int
+	intSums   []int64
+	floatSums []float64
+	// the distinct values with counts of extremeFields.
+	extremes []*btree.BTreeG[aggregateValue]
+}
+
+type aggregateValue struct {
+	value reflect.Value
+	count int
+}
+
+// NewAggregate creates an Aggregate. The fields of data describe how to group rows as Data does,
+// except that DataPtr and RWMutex are set by NewAggregate, and Value should be empty.
+func NewAggregate[K comparable](data Data, options AggregateOptions) *Aggregate[K] {
+	m := &Aggregate[K]{groups: make(map[K]*aggregateGroup), options: options}
+	for _, field := range append(append([]string{}, options.Min...), options.Max...) {
+		if m.extremeIndex(field) < 0 {
+			m.extremeFields = append(m.extremeFields, field)
+		}
+	}
+	data.DataPtr = &m.placeholder
+	data.RWMutex = &m.mutex
+	data.container = m
+	m.data = &data
+	return m
+}
+
+// Data returns the Data to put into Table.Datas.
+func (m *Aggregate[K]) Data() *Data {
+	return m.data
+}
+
+// Get returns the totals of a group, and whether the group exists.
+func (m *Aggregate[K]) Get(key K) (Totals, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	group := m.groups[key]
+	if group == nil {
+		return Totals{}, false
+	}
+	return m.totals(group), true
+}
+
+// Range calls f for each group until f returns false.
+func (m *Aggregate[K]) Range(f func(key K, totals Totals) bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	for key, group := range m.groups {
+		if !f(key, m.totals(group)) {
+			return
+		}
+	}
+}
+
+// Len returns the number of groups.
+func (m *Aggregate[K]) Len() int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return len(m.groups)
+}
+
+func (m *Aggregate[K]) totals(group *aggregateGroup) Totals {
+	totals := Totals{Count: group.count}
+	if len(m.options.Sum) > 0 {
+		totals.Sum = make(map[string]float64, len(m.options.Sum))
+		for i, field := range m.options.Sum {
+			totals.Sum[field] = float64(group.intSums[i]) + group.floatSums[i]
+		}
+	}
+	if len(m.options.Min) > 0 {
+		totals.Min = make(map[string]interface{}, len(m.options.Min))
+		for _, field := range m.options.Min {
+			if item, ok := group.extremes[m.extremeIndex(field)].Min(); ok {
+				totals.Min[field] = item.value.Interface()
+			}
+		}
+	}
+	if len(m.options.Max) > 0 {
+		totals.Max = make(map[string]interface{}, len(m.options.Max))
+		for _, field := range m.options.Max {
+			if item, ok := group.extremes[m.extremeIndex(field)].Max(); ok {
+				totals.Max[field] = item.value.Interface()
+			}
+		}
+	}
+	return totals
+}
+
+func (m *Aggregate[K]) extremeIndex(field string) int {
+	for i, f := range m.extremeFields {
+		if f == field {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *Aggregate[K]) check(d *Data, rowStruct reflect.Type) error {
+	if len(d.mapKeys) != 1 {
+		return errors.New("Aggregate: Data.DataPtr should be a 1 layer map.")
+	}
+	if d.Value != "" {
+		return errors.New("Aggregate: Data.Value should be empty.")
+	}
+	for _, name := range m.options.Sum {
+		field, ok := rowStruct.FieldByName(name)
+		if !ok {
+			return fmt.Errorf("Aggregate: Sum %s, no such field in row struct.", name)
+		}
+		switch field.Type.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+		default:
+			return fmt.Errorf("Aggregate: Sum %s, should be a integer or float type.", name)
+		}
+	}
+	m.extremeCmps = make([]func(a, b reflect.Value) int, len(m.extremeFields))
+	for i, name := range m.extremeFields {
+		field, ok := rowStruct.FieldByName(name)
+		if !ok {
+			return fmt.Errorf("Aggregate: Min or Max %s, no such field in row struct.", name)
+		}
+		cmp, err := compareFunc(field.Type)
+		if err != nil {
+			return fmt.Errorf("Aggregate: Min or Max %s, %v", name, err)
+		}
+		m.extremeCmps[i] = cmp
+	}
+	return nil
+}
+
+func (m *Aggregate[K]) countsRows() {}
+
+func (m *Aggregate[K]) save(d *Data, row reflect.Value) {
+	d.eachMapKey(row, 0, func(keyV reflect.Value) {
+		key := keyV.Interface().(K)
+		group := m.groups[key]
+		if group == nil {
+			group = m.newGroup()
+			m.groups[key] = group
+		}
+		m.update(group, row, 1)
+	})
+}
+
+func (m *Aggregate[K]) remove(d *Data, row reflect.Value) {
+	d.eachMapKey(row, 0, func(keyV reflect.Value) {
+		key := keyV.Interface().(K)
+		group := m.groups[key]
+		if group == nil {
+			return
+		}
+		m.update(group, row, -1)
+		if group.count <= 0 {
+			delete(m.groups, key)
+		}
+	})
+}
+
+// update adds the row to the group if delta is 1, or removes it if delta is -1.
+func (m *Aggregate[K]) update(group *aggregateGroup, row reflect.Value, delta int) {
+	group.count += delta
+	for i, name := range m.options.Sum {
+		field := row.FieldByName(name)
+		switch field.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			group.intSums[i] += int64(delta) * field.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			group.intSums[i] += int64(delta) * int64(field.Uint())
+		default:
+			group.floatSums[i] += float64(delta) * field.Float()
+		}
+	}
+	for i, name := range m.extremeFields {
+		tree := group.extremes[i]
+		item, _ := tree.Get(aggregateValue{value: row.FieldByName(name)})
+		if !item.value.IsValid() {
+			item.value = row.FieldByName(name)
+		}
+		item.count += delta
+		if item.count > 0 {
+			tree.ReplaceOrInsert(item)
+		} else {
+			tree.Delete(item)
+		}
+	}
+}
+
+func (m *Aggregate[K]) newGroup() *aggregateGroup {
+	group := &aggregateGroup{
+		intSums:   make([]int64, len(m.options.Sum)),
+		floatSums: make([]float64, len(m.options.Sum)),
+		extremes:  make([]*btree.BTreeG[aggregateValue], len(m.extremeFields)),
+	}
+	for i := range group.extremes {
+		cmp := m.extremeCmps[i]
+		group.extremes[i] = btree.NewG(8, func(a, b aggregateValue) bool {
+			return cmp(a.value, b.value) < 0
+		})
+	}
+	return group
+}
+
+func (m *Aggregate[K]) clear() {
+	m.groups = make(map[K]*aggregateGroup)
+}
+
+func (m *Aggregate[K]) build(d *Data, rows reflect.Value) reflect.Value {
+	shadow := *d
+	aggregate := &Aggregate[K]{
+		groups: make(map[K]*aggregateGroup), options: m.options,
+		extremeFields: m.extremeFields, extremeCmps: m.extremeCmps,
+	}
+	shadow.container = aggregate
+	for i := 0; i < rows.Len(); i++ {
+		shadow.saveLocked(rows.Index(i))
+	}
+	return reflect.ValueOf(aggregate.groups)
+}
+
+func (m *Aggregate[K]) replace(container reflect.Value) {
+	m.groups = container.Interface().(map[K]*aggregateGroup)
+}
+
+func (m *Aggregate[K]) publish() {
+}
+
+func (m *Aggregate[K]) size() int {
+	return m.Len()
+}
+
+func (m *Aggregate[K]) value() reflect.Value {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	result := make(map[K]Totals, len(m.groups))
+	for key, group := range m.groups {
+		result[key] = m.totals(group)
+	}
+	return reflect.ValueOf(result)
+}
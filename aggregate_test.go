@@ -0,0 +1,54 @@
+package pgcache
+
+import "fmt"
+
+func ExampleNewAggregate() {
+	m := NewAggregate[string](Data{MapKeys: []string{"Subject"}}, AggregateOptions{
+		Sum: []string{"Score"}, Min: []string{"Score", "StudentId"}, Max: []string{"Score"},
+	})
+	t := &Table{
+		Name: "scores", RowStruct: Score{}, PrimaryKeys: []string{"StudentId", "Subject"},
+		Datas: []*Data{m.Data()},
+	}
+	querier := &verifyQuerier{rows: []Score{
+		{StudentId: 1001, Subject: "语文", Score: 90}, {StudentId: 1002, Subject: "语文", Score: 80},
+		{StudentId: 1003, Subject: "语文", Score: 80}, {StudentId: 1001, Subject: "数学", Score: 70},
+	}}
+	if err := t.init("db", querier, testLogger); err != nil {
+		panic(err)
+	}
+	t.Init("")
+	fmt.Println(m.Get("语文"))
+
+	// the min is got from the remaining values, when the min is removed.
+	t.Delete("", []byte(`{"StudentId": 1002, "Subject": "语文"}`))
+	fmt.Println(m.Get("语文"))
+	t.Update("",
+		[]byte(`{"StudentId": 1003, "Subject": "语文"}`),
+		[]byte(`{"StudentId": 1003, "Subject": "数学", "Score": 75}`),
+	)
+	fmt.Println(m.Get("语文"))
+	fmt.Println(m.Get("数学"))
+
+	t.Delete("", []byte(`{"StudentId": 1001, "Subject": "语文"}`))
+	fmt.Println(m.Get("语文"))
+	fmt.Println(m.Len(), m.Data().Size())
+
+	// a row notified twice is counted once, since it's deduped by the primary keys.
+	t.Create("", []byte(`{"StudentId": 1001, "Subject": "数学", "Score": 70}`))
+	fmt.Println(m.Get("数学"))
+
+	other := NewAggregate[string](Data{MapKeys: []string{"Subject"}}, AggregateOptions{})
+	fmt.Println((&Table{Name: "scores", RowStruct: Score{}, Datas: []*Data{other.Data()}}).init(
+		"db", querier, testLogger,
+	))
+	// Output:
+	// {3 map[Score:250] map[Score:80 StudentId:1001] map[Score:90]} true
+	// {2 map[Score:170] map[Score:80 StudentId:1001] map[Score:90]} true
+	// {1 map[Score:90] map[Score:90 StudentId:1001] map[Score:90]} true
+	// {2 map[Score:145] map[Score:70 StudentId:1001] map[Score:75]} true
+	// {0 map[] map[] map[]} false
+	// 1 1
+	// {2 map[Score:145] map[Score:70 StudentId:1001] map[Score:75]} true
+	// PrimaryKeys is required.
+}
@@ -0,0 +1,250 @@
+package pgcache
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lovego/sorted_sets"
+)
+
+// AtomicMap is a map to cache table rows, whose readers never lock. The changes are applied to a
+// new version of the map, which is published atomically after a batch of changes (a notification,
+// a transaction or a reload). A version shares the unchanged rows with the previous one, so a large
+// map is not copied on every change. Use AtomicMap.Data as an element of Table.Datas, for example:
+//
+//	students := pgcache.NewAtomicMap[int64, Student](pgcache.Data{MapKeys: []string{"Id"}})
+//	dbCache.Add(&pgcache.Table{
+//		Name: "students", RowStruct: Student{}, Datas: []*pgcache.Data{students.Data()},
+//	})
+//	student, ok := students.Get(1)
+//
+// The values got from an AtomicMap are shared by readers, they must not be modified.
+type AtomicMap[K comparable, V any] struct {
+	current atomic.Pointer[AtomicSnapshot[K, V]]
+	// held by the writers only.
+	mutex sync.RWMutex
+	data  *Data
+	// the version being written, it's nil if no batch of changes is in progress.
+	working *AtomicSnapshot[K, V]
+	// a placeholder for Data.DataPtr, it's never filled.
+	placeholder map[K]V
+}
+
+// AtomicSnapshot is an immutable version of an AtomicMap.
+type AtomicSnapshot[K comparable, V any] struct {
+	// the base map, which is shared by versions and never changed.
+	base map[K]V
+	// the changes after the base map, it's copied when a new version is written. It's merged into a
+	// new base map when it grows too large.
+	changes map[K]atomicChange[V]
+	size    int
+}
+
+type atomicChange[V any] struct {
+	value   V
+	deleted bool
+}
+
+// the min size of changes merged into the base map.
+const minAtomicChanges = 64
+
+// NewAtomicMap creates an AtomicMap. The fields of data describe how to store rows into the map as
+// Data does, except that DataPtr and RWMutex are set by NewAtomicMap. If V is a slice, it's used as
+// a sorted set, as Data does.
+func NewAtomicMap[K comparable, V any](data Data) *AtomicMap[K, V] {
+	m := &AtomicMap[K, V]{}
+	m.current.Store(&AtomicSnapshot[K, V]{base: make(map[K]V)})
+	data.DataPtr = &m.placeholder
+	data.RWMutex = &m.mutex
+	data.container = m
+	m.data = &data
+	return m
+}
+
+// Data returns the Data to put into Table.Datas.
+func (m *AtomicMap[K, V]) Data() *Data {
+	return m.data
+}
+
+// Load returns the current version of the map, which is never changed.
+func (m *AtomicMap[K, V]) Load() *AtomicSnapshot[K, V] {
+	return m.current.Load()
+}
+
+// Get returns the value of the key in the current version, and whether it exists.
+func (m *AtomicMap[K, V]) Get(key K) (V, bool) {
+	return m.current.Load().Get(key)
+}
+
+// Len returns the number of keys in the current version.
+func (m *AtomicMap[K, V]) Len() int {
+	return m.current.Load().Len()
+}
+
+// Get returns the value of the key, and whether it exists.
+func (s *AtomicSnapshot[K, V]) Get(key K) (V, bool) {
+	if change, ok := s.changes[key]; ok {
+		return change.value, !change.deleted
+	}
+	value, ok := s.base[key]
+	return value, ok
+}
+
+// Len returns the number of keys.
+func (s *AtomicSnapshot[K, V]) Len() int {
+	return s.size
+}
+
+// Range calls f for each key and value until f returns false.
+func (s *AtomicSnapshot[K, V]) Range(f func(key K, value V) bool) {
+	for key, change := range s.changes {
+		if !change.deleted && !f(key, change.value) {
+			return
+		}
+	}
+	for key, value := range s.base {
+		if _, ok := s.changes[key]; ok {
+			continue
+		}
+		if !f(key, value) {
+			return
+		}
+	}
+}
+
+// write returns the version being written, it's copied from the current version if not yet.
+func (m *AtomicMap[K, V]) write() *AtomicSnapshot[K, V] {
+	if m.working == nil {
+		current := m.current.Load()
+		m.working = &AtomicSnapshot[K, V]{
+			base: current.base, changes: make(map[K]atomicChange[V], len(current.changes)+1),
+			size: current.size,
+		}
+		for key, change := range current.changes {
+			m.working.changes[key] = change
+		}
+	}
+	return m.working
+}
+
+func (m *AtomicMap[K, V]) check(d *Data, rowStruct reflect.Type) error {
+	if len(d.mapKeys) != 1 {
+		return errors.New("AtomicMap: Data.DataPtr should be a 1 layer map.")
+	}
+	return nil
+}
+
+func (m *AtomicMap[K, V]) save(d *Data, row reflect.Value) {
+	w := m.write()
+	d.eachMapKey(row, 0, func(keyV reflect.Value) {
+		m.saveKey(d, w, m.key(keyV), row)
+	})
+}
+
+func (m *AtomicMap[K, V]) saveKey(d *Data, w *AtomicSnapshot[K, V], key K, row reflect.Value) {
+	old, exists := w.Get(key)
+	var value V
+	valueV := reflect.ValueOf(&value).Elem()
+	if d.isSortedSets {
+		// the old sorted set is shared by the published versions, so it's copied before changed.
+		valueV.Set(sorted_sets.SaveValue(
+			cloneContainer(reflect.ValueOf(old)), d.getValue(row), d.SortedSetUniqueKey...,
+		))
+	} else {
+		valueV.Set(d.getValue(row))
+	}
+	w.changes[key] = atomicChange[V]{value: value}
+	if !exists {
+		w.size++
+	}
+}
+
+func (m *AtomicMap[K, V]) remove(d *Data, row reflect.Value) {
+	w := m.write()
+	d.eachMapKey(row, 0, func(keyV reflect.Value) {
+		m.removeKey(d, w, m.key(keyV), row)
+	})
+}
+
+func (m *AtomicMap[K, V]) removeKey(d *Data, w *AtomicSnapshot[K, V], key K, row reflect.Value) {
+	old, exists := w.Get(key)
+	if !exists {
+		return
+	}
+	if d.isSortedSets {
+		slice := sorted_sets.RemoveValue(
+			cloneContainer(reflect.ValueOf(old)), d.getValue(row), d.SortedSetUniqueKey...,
+		)
+		if slice.IsValid() && slice.Len() > 0 {
+			var value V
+			reflect.ValueOf(&value).Elem().Set(slice)
+			w.changes[key] = atomicChange[V]{value: value}
+			return
+		}
+	}
+	w.changes[key] = atomicChange[V]{deleted: true}
+	w.size--
+}
+
+func (m *AtomicMap[K, V]) clear() {
+	m.working = &AtomicSnapshot[K, V]{base: make(map[K]V)}
+}
+
+func (m *AtomicMap[K, V]) build(d *Data, rows reflect.Value) reflect.Value {
+	// built as a plain map, which becomes the base map of a new version.
+	shadow := *d
+	shadow.container = nil
+	return shadow.build(rows)
+}
+
+func (m *AtomicMap[K, V]) replace(container reflect.Value) {
+	base := container.Interface().(map[K]V)
+	m.working = &AtomicSnapshot[K, V]{base: base, size: len(base)}
+}
+
+func (m *AtomicMap[K, V]) publish() {
+	w := m.working
+	if w == nil {
+		return
+	}
+	m.working = nil
+	// merge the changes into a new base map, if copying them in every version costs more than
+	// copying the base map once in a while.
+	if len(w.changes) > minAtomicChanges && len(w.changes) > int(math.Sqrt(float64(len(w.base)))) {
+		base := make(map[K]V, w.size)
+		for key, value := range w.base {
+			base[key] = value
+		}
+		for key, change := range w.changes {
+			if change.deleted {
+				delete(base, key)
+			} else {
+				base[key] = change.value
+			}
+		}
+		w.base, w.changes = base, nil
+	}
+	m.current.Store(w)
+}
+
+func (m *AtomicMap[K, V]) size() int {
+	return m.Len()
+}
+
+func (m *AtomicMap[K, V]) value() reflect.Value {
+	var result = make(map[K]V, m.Len())
+	m.Load().Range(func(key K, value V) bool {
+		result[key] = value
+		return true
+	})
+	return reflect.ValueOf(result)
+}
+
+func (m *AtomicMap[K, V]) key(keyV reflect.Value) K {
+	var key K
+	reflect.ValueOf(&key).Elem().Set(keyV)
+	return key
+}
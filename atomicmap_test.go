@@ -0,0 +1,61 @@
+package pgcache
+
+import "fmt"
+
+func ExampleNewAtomicMap() {
+	m := NewAtomicMap[int, []Score](Data{
+		MapKeys: []string{"StudentId"}, SortedSetUniqueKey: []string{"Subject"},
+	})
+	t := &Table{Name: "scores", RowStruct: Score{}, Datas: []*Data{m.Data()}}
+	querier := &verifyQuerier{rows: []Score{
+		{StudentId: 1001, Subject: "语文", Score: 90}, {StudentId: 1002, Subject: "语文", Score: 80},
+	}}
+	if err := t.init("db", querier, testLogger); err != nil {
+		panic(err)
+	}
+	t.Init("")
+	snapshot := m.Load()
+	fmt.Println(snapshot.Get(1001))
+
+	t.Create("", []byte(`{"StudentId": 1001, "Subject": "数学", "Score": 95}`))
+	t.Delete("", []byte(`{"StudentId": 1002, "Subject": "语文", "Score": 80}`))
+	t.Update("",
+		[]byte(`{"StudentId": 1001, "Subject": "语文", "Score": 90}`),
+		[]byte(`{"StudentId": 1001, "Subject": "语文", "Score": 85}`),
+	)
+	fmt.Println(m.Get(1001))
+	fmt.Println(m.Get(1002))
+	fmt.Println(m.Len(), m.Data().Size())
+
+	// the snapshot loaded before is not changed.
+	fmt.Println(snapshot.Get(1001))
+	fmt.Println(snapshot.Len())
+	// Output:
+	// [{1001 语文 90}] true
+	// [{1001 数学 95} {1001 语文 85}] true
+	// [] false
+	// 1 1
+	// [{1001 语文 90}] true
+	// 2
+}
+
+func ExampleAtomicMap_publish() {
+	m := NewAtomicMap[int, int](Data{MapKeys: []string{"StudentId"}, Value: "Score"})
+	t := &Table{Name: "scores", RowStruct: Score{}, Datas: []*Data{m.Data()}}
+	if err := t.init("db", &verifyQuerier{}, testLogger); err != nil {
+		panic(err)
+	}
+	t.Init("")
+	for i := 0; i < minAtomicChanges; i++ {
+		t.Create("", []byte(fmt.Sprintf(`{"StudentId": %d, "Score": %d}`, i, i)))
+	}
+	fmt.Println(len(m.Load().base), len(m.Load().changes))
+	// the changes are merged into the base map when they grow too large.
+	t.Create("", []byte(`{"StudentId": 100, "Score": 100}`))
+	fmt.Println(len(m.Load().base), len(m.Load().changes), m.Len())
+	fmt.Println(m.Get(100))
+	// Output:
+	// 0 64
+	// 65 0 65
+	// 100 true
+}
@@ -15,8 +15,14 @@ import (
 type Data struct {
 	*sync.RWMutex
 	// DataPtr is a pointer to a map or slice to store data, required.
+	// When the table is reloaded, the map or slice is replaced by a new one under the lock.
 	DataPtr interface{}
 	// MapKeys is the field names to get map keys from row struct, required if DataPtr is a map.
+	// If a map key is a struct, such as map[ScoreKey]Score, it's composed of the same number of
+	// MapKeys fields, which are assigned to the key struct fields by name if all the names exist in
+	// the key struct, otherwise by order.
+	// If a MapKeys field is a slice of the map key type, such as "Tags []string" for
+	// map[string][]Product, the row is saved under each element of it.
 	MapKeys []string
 	// Value is the field name to get map or slice value from row struct.
 	// If it's empty, the whole row struct is used.
@@ -39,6 +45,8 @@ type Data struct {
 
 	// the data value to store data
 	dataV reflect.Value
+	// the keys of map layers.
+	mapKeys []mapKey
 	// map value is a sorted set
 	isSortedSets bool
 	// real map value is a pointer of the row struct or row struct's {Value} field.
@@ -47,17 +55,73 @@ type Data struct {
 	preprocessMethodIndex int
 	// negative if no Precond present.
 	precondMethodIndex int
+	// keeps only the resident keys, set by NewLazyMap.
+	lazy lazyStore
+	// the container other than a map or slice, set by NewAtomicMap or NewRangeIndex.
+	container containerStore
+	// the Data is being loaded by AddData, the changes are recorded in pending,
+	// and applied after the rows loaded.
+	loading bool
+	pending []func()
+}
+
+// containerStore is implemented by the containers other than a map or slice, such as AtomicMap and
+// RangeIndex. The methods except size and value are called with the lock of the Data held.
+type containerStore interface {
+	// check the Data after it's initialized.
+	check(d *Data, rowStruct reflect.Type) error
+	save(d *Data, row reflect.Value)
+	remove(d *Data, row reflect.Value)
+	clear()
+	// build a new container of the rows aside.
+	build(d *Data, rows reflect.Value) reflect.Value
+	// replace the container by one built by build.
+	replace(container reflect.Value)
+	// publish the changes made under the lock.
+	publish()
+	size() int
+	// value returns the content as a map or slice for the manage page.
+	value() reflect.Value
+}
+
+// rowCounter is implemented by the containers which count rows, such as Aggregate. A row saved
+// twice is counted twice, so they require the rows by primary key to dedupe the changes.
+type rowCounter interface {
+	countsRows()
+}
+
+func (d *Data) countsRows() bool {
+	_, ok := d.container.(rowCounter)
+	return ok
 }
 
 func (d *Data) save(row reflect.Value) {
+	d.Lock()
+	defer d.Unlock()
+	d.saveLocked(row)
+	d.publish()
+}
+
+// saveLocked saves the row, the caller should hold the lock.
+func (d *Data) saveLocked(row reflect.Value) {
+	if d.loading {
+		d.pending = append(d.pending, func() { d.saveLocked(row) })
+		return
+	}
 	d.preprocess(row)
 	if !d.precond(row) {
 		return
 	}
-	d.Lock()
-	defer d.Unlock()
-
-	if d.dataV.Kind() == reflect.Slice {
+	if d.lazy != nil {
+		key := d.mapKey(row, 0)
+		if !d.lazy.resident(key) {
+			return
+		}
+		defer d.lazy.changed(key)
+	}
+	if d.container != nil {
+		d.container.save(d, row)
+	} else if d.dataV.Kind() == reflect.Slice {
 		d.dataV.Set(sorted_sets.SaveValue(d.dataV, d.getValue(row), d.SortedSetUniqueKey...))
 	} else {
 		d.saveToMap(row)
@@ -65,39 +129,58 @@ func (d *Data) save(row reflect.Value) {
 }
 
 func (d *Data) saveToMap(row reflect.Value) {
-	mapV := d.dataV
-	if mapV.IsNil() {
-		mapV.Set(reflect.MakeMap(mapV.Type()))
-	}
-	for i := 0; i < len(d.MapKeys)-1; i++ {
-		key := row.FieldByName(d.MapKeys[i])
-		value := mapV.MapIndex(key)
-		if !value.IsValid() {
-			value = reflect.MakeMap(mapV.Type().Elem())
-			mapV.SetMapIndex(key, value)
-		} else if value.IsNil() {
-			value.Set(reflect.MakeMap(mapV.Type().Elem()))
-		}
-		mapV = value
+	if d.dataV.IsNil() {
+		d.dataV.Set(reflect.MakeMap(d.dataV.Type()))
 	}
+	d.saveToLayer(d.dataV, 0, row)
+}
 
-	key := row.FieldByName(d.MapKeys[len(d.MapKeys)-1])
-	value := d.getValue(row)
-	if d.isSortedSets {
-		value = sorted_sets.SaveValue(mapV.MapIndex(key), value, d.SortedSetUniqueKey...)
-	}
-	mapV.SetMapIndex(key, value)
+func (d *Data) saveToLayer(mapV reflect.Value, layer int, row reflect.Value) {
+	d.eachMapKey(row, layer, func(key reflect.Value) {
+		if layer < len(d.mapKeys)-1 {
+			value := mapV.MapIndex(key)
+			if !value.IsValid() || value.IsNil() {
+				value = reflect.MakeMap(mapV.Type().Elem())
+				mapV.SetMapIndex(key, value)
+			}
+			d.saveToLayer(value, layer+1, row)
+			return
+		}
+		value := d.getValue(row)
+		if d.isSortedSets {
+			value = sorted_sets.SaveValue(mapV.MapIndex(key), value, d.SortedSetUniqueKey...)
+		}
+		mapV.SetMapIndex(key, value)
+	})
 }
 
 func (d *Data) remove(row reflect.Value) {
+	d.Lock()
+	defer d.Unlock()
+	d.removeLocked(row)
+	d.publish()
+}
+
+// removeLocked removes the row, the caller should hold the lock.
+func (d *Data) removeLocked(row reflect.Value) {
+	if d.loading {
+		d.pending = append(d.pending, func() { d.removeLocked(row) })
+		return
+	}
 	d.preprocess(row)
 	if !d.precond(row) {
 		return
 	}
-	d.Lock()
-	defer d.Unlock()
-
-	if d.dataV.Kind() == reflect.Slice {
+	if d.lazy != nil {
+		key := d.mapKey(row, 0)
+		if !d.lazy.resident(key) {
+			return
+		}
+		defer d.lazy.changed(key)
+	}
+	if d.container != nil {
+		d.container.remove(d, row)
+	} else if d.dataV.Kind() == reflect.Slice {
 		d.dataV.Set(sorted_sets.RemoveValue(d.dataV, d.getValue(row), d.SortedSetUniqueKey...))
 	} else {
 		d.removeFromMap(row)
@@ -105,41 +188,132 @@ func (d *Data) remove(row reflect.Value) {
 }
 
 func (d *Data) removeFromMap(row reflect.Value) {
-	mapV := d.dataV
-	for i := 0; i < len(d.MapKeys)-1; i++ {
-		key := row.FieldByName(d.MapKeys[i])
-		mapV = mapV.MapIndex(key)
-		if !mapV.IsValid() || mapV.IsNil() {
-			return
-		}
-	}
-	key := row.FieldByName(d.MapKeys[len(d.MapKeys)-1])
-	if d.isSortedSets {
-		slice := mapV.MapIndex(key)
-		if !slice.IsValid() {
+	d.removeFromLayer(d.dataV, 0, row)
+}
+
+func (d *Data) removeFromLayer(mapV reflect.Value, layer int, row reflect.Value) {
+	d.eachMapKey(row, layer, func(key reflect.Value) {
+		if layer < len(d.mapKeys)-1 {
+			if value := mapV.MapIndex(key); value.IsValid() && !value.IsNil() {
+				d.removeFromLayer(value, layer+1, row)
+			}
 			return
 		}
-		slice = sorted_sets.RemoveValue(slice, d.getValue(row), d.SortedSetUniqueKey...)
-		if !slice.IsValid() || slice.Len() == 0 {
-			mapV.SetMapIndex(key, reflect.Value{})
+		if d.isSortedSets {
+			slice := mapV.MapIndex(key)
+			if !slice.IsValid() {
+				return
+			}
+			slice = sorted_sets.RemoveValue(slice, d.getValue(row), d.SortedSetUniqueKey...)
+			if !slice.IsValid() || slice.Len() == 0 {
+				mapV.SetMapIndex(key, reflect.Value{})
+			} else {
+				mapV.SetMapIndex(key, slice)
+			}
 		} else {
-			mapV.SetMapIndex(key, slice)
+			mapV.SetMapIndex(key, reflect.Value{})
 		}
-	} else {
-		mapV.SetMapIndex(key, reflect.Value{})
-	}
+	})
 }
 
 func (d *Data) clear() {
 	d.Lock()
 	defer d.Unlock()
-	if d.dataV.Kind() == reflect.Slice {
+	d.clearLocked()
+	d.publish()
+}
+
+// clearLocked clears the data, the caller should hold the lock.
+func (d *Data) clearLocked() {
+	if d.loading {
+		d.pending = append(d.pending[:0], d.clearLocked)
+		return
+	}
+	if d.lazy != nil {
+		d.lazy.cleared()
+	}
+	if d.container != nil {
+		d.container.clear()
+	} else if d.dataV.Kind() == reflect.Slice {
 		d.dataV.Set(reflect.MakeSlice(d.dataV.Type(), 0, d.dataV.Cap()))
 	} else {
 		d.dataV.Set(reflect.MakeMap(d.dataV.Type()))
 	}
 }
 
+// build builds a new container of the rows aside, the current one is not changed.
+func (d *Data) build(rows reflect.Value) reflect.Value {
+	if d.container != nil {
+		return d.container.build(d, rows)
+	}
+	shadow := *d
+	shadow.lazy = nil
+	shadow.loading, shadow.pending = false, nil
+	shadow.dataV = reflect.New(d.dataV.Type()).Elem()
+	shadow.clearLocked()
+	for i := 0; i < rows.Len(); i++ {
+		shadow.saveLocked(rows.Index(i))
+	}
+	return shadow.dataV
+}
+
+// replace the container by one built by build, the caller should hold the lock.
+func (d *Data) replace(container reflect.Value) {
+	if d.loading {
+		d.pending = append(d.pending[:0], func() { d.replace(container) })
+		return
+	}
+	if d.container != nil {
+		d.container.replace(container)
+	} else {
+		d.dataV.Set(container)
+	}
+}
+
+// publish the changes made under the lock, if the data has a container such as AtomicMap.
+func (d *Data) publish() {
+	if d.container != nil {
+		d.container.publish()
+	}
+}
+
+// mapKey is the key of a map layer.
+type mapKey struct {
+	// the row struct fields to get the key.
+	fields []string
+	// the struct type of a composite key, nil if the key is a single field.
+	keyType reflect.Type
+	// the index of key struct field for each of fields.
+	keyFields []int
+	// the field is a slice, the row is saved under each element of it.
+	multi bool
+}
+
+// mapKey returns the key of the map layer from the row.
+func (d *Data) mapKey(row reflect.Value, layer int) reflect.Value {
+	k := d.mapKeys[layer]
+	if k.keyType == nil {
+		return row.FieldByName(k.fields[0])
+	}
+	key := reflect.New(k.keyType).Elem()
+	for i, name := range k.fields {
+		key.Field(k.keyFields[i]).Set(row.FieldByName(name))
+	}
+	return key
+}
+
+// eachMapKey calls f with each key of the map layer from the row.
+func (d *Data) eachMapKey(row reflect.Value, layer int, f func(key reflect.Value)) {
+	if !d.mapKeys[layer].multi {
+		f(d.mapKey(row, layer))
+		return
+	}
+	keys := d.mapKey(row, layer)
+	for i := 0; i < keys.Len(); i++ {
+		f(keys.Index(i))
+	}
+}
+
 func (d *Data) getValue(row reflect.Value) reflect.Value {
 	value := row
 	if d.Value != "" {
@@ -168,7 +342,11 @@ func (d *Data) precond(row reflect.Value) bool {
 
 func (d *Data) Key() string {
 	if d.manageKey == `` {
-		d.manageKey = addKeyValueNames(d.dataV.Type().String(), d.MapKeys, d.Value)
+		var keyNames = make([]string, len(d.mapKeys))
+		for i, key := range d.mapKeys {
+			keyNames[i] = strings.Join(key.fields, ",")
+		}
+		d.manageKey = addKeyValueNames(d.dataV.Type().String(), keyNames, d.Value)
 		if d.Precond != "" {
 			d.manageKey += fmt.Sprintf("(%s)", d.Precond)
 		}
@@ -177,22 +355,33 @@ func (d *Data) Key() string {
 }
 
 func (d *Data) Size() int {
+	if d.container != nil {
+		return d.container.size()
+	}
 	return d.dataV.Len()
 }
 
 func (d *Data) Data(keys ...string) (interface{}, error) {
+	var data = d.dataV
+	if d.container != nil {
+		data = d.container.value()
+	}
 	if len(keys) == 0 {
+		if d.container != nil {
+			return data.Interface(), nil
+		}
 		return d.DataPtr, nil
 	}
-	var data = d.dataV
+	var layer int
 	for _, str := range keys {
 		switch data.Kind() {
 		case reflect.Map:
-			if key, err := convertStrToType(str, data.Type().Key()); err != nil {
+			if key, err := d.convertMapKey(str, data.Type().Key(), layer); err != nil {
 				return nil, err
 			} else {
 				data = data.MapIndex(key)
 			}
+			layer++
 		case reflect.Slice, reflect.Array:
 			if index, err := strconv.Atoi(str); err != nil {
 				return nil, err
@@ -211,7 +400,36 @@ func (d *Data) Data(keys ...string) (interface{}, error) {
 	return data.Interface(), nil
 }
 
-var mapKeyRegexp = regexp.MustCompile(`\[\w+\]`)
+// the separator of the fields of a composite key in Data.Data, since the keys are separated by ","
+// on the manage page.
+const compositeKeySeparator = "|"
+
+// convertMapKey converts str to the key of the map layer. The fields of a composite key are in the
+// order of "MapKeys", and separated by compositeKeySeparator.
+func (d *Data) convertMapKey(str string, typ reflect.Type, layer int) (reflect.Value, error) {
+	if layer >= len(d.mapKeys) || d.mapKeys[layer].keyType == nil {
+		return convertStrToType(str, typ)
+	}
+	k := d.mapKeys[layer]
+	fields := strings.Split(str, compositeKeySeparator)
+	if len(fields) != len(k.fields) {
+		return reflect.Value{}, fmt.Errorf(
+			"%v needs %d fields seperated by %q", typ, len(k.fields), compositeKeySeparator,
+		)
+	}
+	key := reflect.New(typ).Elem()
+	for i, field := range fields {
+		keyField := key.Field(k.keyFields[i])
+		fieldV, err := convertStrToType(strings.TrimSpace(field), keyField.Type())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		keyField.Set(fieldV)
+	}
+	return key, nil
+}
+
+var mapKeyRegexp = regexp.MustCompile(`\[[\w.]+\]`)
 
 func addKeyValueNames(mapType string, keyNames []string, valueName string) string {
 	i := 0
@@ -219,6 +219,81 @@ func ExampleData_save_remove_clear_sorted_sets_3() {
 	// map[]
 }
 
+func ExampleData_save_remove_compositeKeys() {
+	mutex := sync.RWMutex{}
+	var m map[string]map[scoreKey]int
+	d := Data{
+		RWMutex: &mutex,
+		DataPtr: &m, MapKeys: []string{"Subject", "StudentId", "Subject"}, Value: "Score",
+	}
+	fmt.Println(d.init(reflect.TypeOf(Score{})))
+	d.clear()
+	fmt.Println(d.Key())
+
+	rows := reflect.ValueOf([]Score{
+		{StudentId: 1001, Subject: "语文", Score: 98},
+		{StudentId: 1002, Subject: "语文", Score: 90},
+		{StudentId: 1001, Subject: "数学", Score: 99},
+	})
+	for i := 0; i < rows.Len(); i++ {
+		d.save(rows.Index(i))
+	}
+	fmt.Println(m)
+	d.remove(rows.Index(1))
+	fmt.Println(m)
+	// the fields of a composite key are in the order of MapKeys.
+	fmt.Println(d.Data("语文", "1001|语文"))
+	fmt.Println(d.Data("语文", "语文|1001"))
+	fmt.Println(d.Data("语文", "1001"))
+	// Output:
+	// <nil>
+	// map[Subject:string]map[StudentId,Subject:pgcache.scoreKey]Score:int
+	// map[数学:map[{数学 1001}:99] 语文:map[{语文 1001}:98 {语文 1002}:90]]
+	// map[数学:map[{数学 1001}:99] 语文:map[{语文 1001}:98]]
+	// 98 <nil>
+	// <nil> strconv.ParseInt: parsing "语文": invalid syntax
+	// <nil> pgcache.scoreKey needs 2 fields seperated by "|"
+}
+
+type product struct {
+	Id   int
+	Tags []string
+}
+
+func ExampleData_save_remove_multiValuedKeys() {
+	mutex := sync.RWMutex{}
+	var m1 map[string][]product
+	var m2 map[string]map[int]int
+	d1 := Data{
+		RWMutex: &mutex, DataPtr: &m1, MapKeys: []string{"Tags"}, SortedSetUniqueKey: []string{"Id"},
+	}
+	d2 := Data{RWMutex: &mutex, DataPtr: &m2, MapKeys: []string{"Tags", "Id"}, Value: "Id"}
+	fmt.Println(d1.init(reflect.TypeOf(product{})), d2.init(reflect.TypeOf(product{})))
+
+	rows := reflect.ValueOf([]product{
+		{Id: 1, Tags: []string{"a", "b"}},
+		{Id: 2, Tags: []string{"b", "c"}},
+		{Id: 3},
+	})
+	for i := 0; i < rows.Len(); i++ {
+		d1.save(rows.Index(i))
+		d2.save(rows.Index(i))
+	}
+	fmt.Println(m1)
+	fmt.Println(m2)
+
+	d1.remove(rows.Index(1))
+	d2.remove(rows.Index(1))
+	fmt.Println(m1)
+	fmt.Println(m2)
+	// Output:
+	// <nil> <nil>
+	// map[a:[{1 [a b]}] b:[{1 [a b]} {2 [b c]}] c:[{2 [b c]}]]
+	// map[a:map[1:1] b:map[1:1 2:2] c:map[2:2]]
+	// map[a:[{1 [a b]}] b:[{1 [a b]}]]
+	// map[a:map[1:1] b:map[1:1] c:map[]]
+}
+
 func ExampleAddKeyValueNames() {
 	var m map[string]map[int64]*uint16
 	src := reflect.TypeOf(m).String()
@@ -23,6 +23,11 @@ func (d *Data) init(rowStruct reflect.Type) error {
 	if err != nil {
 		return err
 	}
+	if d.container != nil {
+		if err := d.container.check(d, rowStruct); err != nil {
+			return err
+		}
+	}
 	if innerType.Kind() == reflect.Slice {
 		innerType = innerType.Elem()
 		d.isSortedSets = true
@@ -50,15 +55,30 @@ func (d *Data) checkMapKeys(rowStruct reflect.Type) (reflect.Type, error) {
 		}
 	}
 
-	layers := 0
+	d.mapKeys = nil
+	layers, fields, composite := 0, 0, false
 	for ; typ.Kind() == reflect.Map; layers++ {
-		if err := d.checkMapKey(layers, rowStruct, typ.Key()); err != nil {
+		key, err := d.checkMapKey(fields, rowStruct, typ.Key())
+		if err != nil {
 			return nil, err
 		}
+		d.mapKeys = append(d.mapKeys, key)
+		if key.keyType != nil {
+			composite = true
+			fields += len(key.fields)
+		} else {
+			fields++
+		}
 		typ = typ.Elem()
 	}
 
-	if layers != len(d.MapKeys) {
+	if fields != len(d.MapKeys) {
+		if composite {
+			return nil, fmt.Errorf(
+				"Data.DataPtr is a %d layers map of %d key fields, but Data.MapKeys has %d field.",
+				layers, fields, len(d.MapKeys),
+			)
+		}
 		return nil, fmt.Errorf(
 			"Data.DataPtr is a %d layers map, but Data.MapKeys has %d field.", layers, len(d.MapKeys),
 		)
@@ -66,21 +86,71 @@ func (d *Data) checkMapKeys(rowStruct reflect.Type) (reflect.Type, error) {
 	return typ, nil
 }
 
-func (d *Data) checkMapKey(i int, rowStruct, keyType reflect.Type) error {
+func (d *Data) checkMapKey(i int, rowStruct, keyType reflect.Type) (mapKey, error) {
 	if i >= len(d.MapKeys) {
-		return nil
+		return mapKey{}, nil
 	}
 	name := d.MapKeys[i]
 	field, ok := rowStruct.FieldByName(name)
 	if !ok {
-		return fmt.Errorf("Data.MapKeys[%d]: %s, no such field in row struct.", i, name)
+		return mapKey{}, fmt.Errorf("Data.MapKeys[%d]: %s, no such field in row struct.", i, name)
+	}
+	if field.Type.AssignableTo(keyType) {
+		return mapKey{fields: []string{name}}, nil
 	}
-	if !field.Type.AssignableTo(keyType) {
-		return fmt.Errorf(
-			"Data.MapKeys[%d]: %s, type %v is not assignable to %v.", i, name, field.Type, keyType,
+	if field.Type.Kind() == reflect.Slice && field.Type.Elem().AssignableTo(keyType) {
+		return mapKey{fields: []string{name}, multi: true}, nil
+	}
+	if keyType.Kind() == reflect.Struct {
+		return d.checkCompositeKey(i, rowStruct, keyType)
+	}
+	return mapKey{}, fmt.Errorf(
+		"Data.MapKeys[%d]: %s, type %v is not assignable to %v.", i, name, field.Type, keyType,
+	)
+}
+
+// checkCompositeKey checks a struct map key composed of the MapKeys fields starting from i.
+// The fields are assigned to the key struct fields by name if all the names exist in the key
+// struct, otherwise by order.
+func (d *Data) checkCompositeKey(i int, rowStruct, keyType reflect.Type) (mapKey, error) {
+	n := keyType.NumField()
+	if i+n > len(d.MapKeys) {
+		return mapKey{}, fmt.Errorf(
+			"Data.MapKeys[%d]: %v has %d fields, but Data.MapKeys has %d field left.",
+			i, keyType, n, len(d.MapKeys)-i,
 		)
 	}
-	return nil
+	key := mapKey{fields: d.MapKeys[i : i+n], keyType: keyType, keyFields: make([]int, n)}
+	byName := true
+	for _, name := range key.fields {
+		if field, ok := keyType.FieldByName(name); !ok || len(field.Index) != 1 {
+			byName = false
+			break
+		}
+	}
+	for j, name := range key.fields {
+		field, ok := rowStruct.FieldByName(name)
+		if !ok {
+			return mapKey{}, fmt.Errorf("Data.MapKeys[%d]: %s, no such field in row struct.", i+j, name)
+		}
+		keyField := keyType.Field(j)
+		if byName {
+			keyField, _ = keyType.FieldByName(name)
+		}
+		if keyField.PkgPath != "" {
+			return mapKey{}, fmt.Errorf(
+				"Data.MapKeys[%d]: %s, field %s of %v is not exported.", i+j, name, keyField.Name, keyType,
+			)
+		}
+		if !field.Type.AssignableTo(keyField.Type) {
+			return mapKey{}, fmt.Errorf(
+				"Data.MapKeys[%d]: %s, type %v is not assignable to %v.%s.",
+				i+j, name, field.Type, keyType, keyField.Name,
+			)
+		}
+		key.keyFields[j] = keyField.Index[0]
+	}
+	return key, nil
 }
 
 func (d *Data) checkValue(rowStruct, realValueType reflect.Type) (reflect.Type, error) {
@@ -181,6 +181,46 @@ func ExampleData_init_invalidSortedSetUniqueKey_5() {
 	// Data.SortedSetUniqueKey[0]: ScoreFloat, should be a integer or string type.
 }
 
+type scoreKey struct {
+	Subject   string
+	StudentId int
+}
+
+func ExampleData_init_compositeKeys() {
+	mutex := sync.RWMutex{}
+	var m1 map[scoreKey]int
+	for _, mapKeys := range [][]string{
+		{"StudentId", "Subject"}, // by name
+		{"Subject", "StudentId"}, // by name
+		{"StudentId"},
+		{"StudentId", "Subject", "Score"},
+	} {
+		d := Data{RWMutex: &mutex, DataPtr: &m1, MapKeys: mapKeys, Value: "Score"}
+		fmt.Println(d.init(reflect.TypeOf(Score{})))
+	}
+
+	var m2 map[struct{ A, B string }]int
+	for _, mapKeys := range [][]string{
+		{"Subject", "Subject"}, // by order
+		{"Subject", "StudentId"},
+	} {
+		d := Data{RWMutex: &mutex, DataPtr: &m2, MapKeys: mapKeys, Value: "Score"}
+		fmt.Println(d.init(reflect.TypeOf(Score{})))
+	}
+
+	var m3 map[struct{ a, b int }]int
+	d := Data{RWMutex: &mutex, DataPtr: &m3, MapKeys: []string{"StudentId", "Score"}, Value: "Score"}
+	fmt.Println(d.init(reflect.TypeOf(Score{})))
+	// Output:
+	// <nil>
+	// <nil>
+	// Data.MapKeys[0]: pgcache.scoreKey has 2 fields, but Data.MapKeys has 1 field left.
+	// Data.DataPtr is a 1 layers map of 2 key fields, but Data.MapKeys has 3 field.
+	// <nil>
+	// Data.MapKeys[1]: StudentId, type int is not assignable to struct { A string; B string }.B.
+	// Data.MapKeys[0]: StudentId, field a of struct { a int; b int } is not exported.
+}
+
 func ExampleData_init_flags1() {
 	mutex := sync.RWMutex{}
 	var m map[int]map[string][]*int
@@ -1,19 +1,95 @@
 package pgcache
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/lovego/pgcache/manage"
 	"github.com/lovego/pgcache/pglistener"
 )
 
 type DB struct {
-	name      string
-	listener  *pglistener.Listener
-	dbQuerier DBQuerier
-	logger    Logger
+	name     string
+	listener Listener
+	// polls the tables whose Table.Polling is set, it's also the listener if Options.Polling is true.
+	poller *pglistener.PollingListener
+	// the default PollOptions of the tables, if Options.Polling is true.
+	pollOptions pglistener.PollOptions
+	dbQuerier   DBQuerier
+	logger      Logger
+	changeLog   bool
+
+	// the tables added, to stop their verifiers and unlisten them when they're removed.
+	tables      map[string]*Table
+	tablesMutex sync.Mutex
+}
+
+// Listener listens for the changes of tables, and passes them to the handlers.
+// It's implemented by pglistener.Listener, pglistener.ReplicationListener and
+// pglistener.PollingListener.
+type Listener interface {
+	Listen(table string, columns, checkColumns string, handler pglistener.Handler) error
+	Unlisten(table string) error
+	UnlistenAll() error
+	Close(ctx context.Context) error
+}
+
+// Syncer is implemented by pglistener.Listener and pglistener.PollingListener, see DB.Sync.
+type Syncer interface {
+	Sync(ctx context.Context, table string) error
+}
+
+type Options struct {
+	// Consumer is the name of this application. It's used to derive the names of triggers and
+	// channels, so multiple applications can cache different columns of the same table.
+	Consumer string
+	// If not empty, the changes of tables are got from a logical replication slot of this name
+	// using the pgoutput plugin, instead of triggers and LISTEN/NOTIFY. The cached tables must be
+	// altered to "REPLICA IDENTITY FULL" in advance. The server retains the WAL not consumed by the
+	// slot, use DB.DropReplicationSlot after Close if the slot is not used any more.
+	ReplicationSlot string
+	// If ChangeLog is true, the changes are also logged into the "pgcache_changes" table, so the
+	// changes missed during a connection loss are replayed instead of reloading the whole tables.
+	// Use DB.PruneChanges to delete old changes periodically. It's ignored if ReplicationSlot is set.
+	ChangeLog bool
+	// If Transactional is true, the changes of a transaction are applied to the Datas of a table
+	// together, so readers never see a partially applied transaction. It's ignored if
+	// ReplicationSlot is set, which is always transactional.
+	Transactional bool
+	// In Transactional mode, a transaction without the end marker (such as consisting only of
+	// TRUNCATE) is applied if no new change arrives within TxEndTimeout, 100ms by default.
+	TxEndTimeout time.Duration
+	// If StatementLevel is true, statement level triggers (PostgreSQL 10+) are used, so a statement
+	// changing many rows sends only one notification. If the rows changed by a statement exceed
+	// BulkThreshold, the whole table is reloaded. In KeyOnly mode, only the primary keys are
+	// notified, so the changed rows are reloaded by a targeted query instead. It's ignored if
+	// ReplicationSlot is set.
+	StatementLevel bool
+	// The max number of rows notified by a statement in StatementLevel mode, 1000 by default.
+	BulkThreshold int
+	// If DropTriggers is true, the triggers of a table are dropped when it's removed or the DB is
+	// closed. Don't use it if other processes of the same Consumer cache the table.
+	DropTriggers bool
+	// Workers is the policy to apply the changes of tables. By default, all tables are updated by a
+	// single goroutine. Use pglistener.TableWorkers to update every table by its own goroutine, so
+	// a slow table (for example, loading "BigColumns") doesn't hold up the others. It's ignored if
+	// ReplicationSlot is set.
+	Workers pglistener.WorkerPolicy
+	// The max number of changes queued for a worker, 1000 by default. In TableWorkers mode, if the
+	// queue of a table is full, the table is reloaded after the queue is drained.
+	QueueSize int
+	// If Polling is true, the changes of all tables are polled by PollOptions, instead of triggers
+	// and LISTEN/NOTIFY. Use it if functions and triggers can't be created in the database, such as
+	// a read replica. To poll only some tables, use Table.Polling instead. If PollOptions.KeyColumns
+	// is empty, the columns of Table.PrimaryKeys are used as Table.Polling does.
+	Polling     bool
+	PollOptions pglistener.PollOptions
 }
 
 type DBQuerier interface {
@@ -27,38 +103,177 @@ type Logger interface {
 }
 
 func New(dbAddr string, dbQuerier DBQuerier, logger Logger) (*DB, error) {
+	return NewWithOptions(dbAddr, dbQuerier, logger, Options{})
+}
+
+func NewWithOptions(dbAddr string, dbQuerier DBQuerier, logger Logger, options Options) (*DB, error) {
 	var dbName string
 	if uri, err := url.Parse(dbAddr); err != nil {
 		return nil, err
 	} else {
 		dbName = strings.TrimPrefix(uri.Path, "/")
 	}
-	listener, err := pglistener.New(dbAddr, dbQuerier.GetDB(), logger)
+	poller, err := pglistener.NewPolling(dbAddr, dbQuerier.GetDB(), logger, options.PollOptions)
 	if err != nil {
 		return nil, err
 	}
-	return &DB{name: dbName, listener: listener, dbQuerier: dbQuerier, logger: logger}, nil
+	var listener Listener
+	if options.Polling {
+		listener = poller
+	} else if options.ReplicationSlot != "" {
+		listener, err = pglistener.NewReplication(
+			dbAddr, dbQuerier.GetDB(), options.ReplicationSlot, logger,
+		)
+	} else {
+		listener, err = pglistener.NewWithOptions(dbAddr, dbQuerier.GetDB(), logger,
+			pglistener.Options{
+				Consumer: options.Consumer, ChangeLog: options.ChangeLog,
+				Transactional: options.Transactional, TxEndTimeout: options.TxEndTimeout,
+				StatementLevel: options.StatementLevel, BulkThreshold: options.BulkThreshold,
+				DropTriggers: options.DropTriggers, Workers: options.Workers, QueueSize: options.QueueSize,
+			},
+		)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &DB{
+		name: dbName, listener: listener, poller: poller, pollOptions: options.PollOptions,
+		dbQuerier: dbQuerier, logger: logger,
+		changeLog: options.ChangeLog && options.ReplicationSlot == "" && !options.Polling,
+		tables:    make(map[string]*Table),
+	}, nil
 }
 
 func (db *DB) Add(table *Table) (*Table, error) {
+	table.polled = table.Polling != nil || db.listener == db.poller
 	if err := table.init(db.name, db.dbQuerier, db.logger); err != nil {
 		return nil, err
 	}
-	if err := db.listener.Listen(table.Name, table.Columns, table.BigColumns, table); err != nil {
-		return nil, err
+	columns, checkColumns := table.notifyColumns()
+	if table.polled {
+		options := db.pollOptions
+		if table.Polling != nil {
+			options = *table.Polling
+		}
+		if options.KeyColumns == "" && len(table.PrimaryKeys) > 0 {
+			var columns = make([]string, len(table.PrimaryKeys))
+			for i, field := range table.PrimaryKeys {
+				columns[i] = Field2Column(field)
+			}
+			options.KeyColumns = strings.Join(columns, ",")
+		}
+		if err := db.poller.ListenWithOptions(table.Name, columns, options, table); err != nil {
+			return nil, err
+		}
+	} else {
+		table.changeLog = db.changeLog
+		if err := db.listener.Listen(table.Name, columns, checkColumns, table); err != nil {
+			return nil, err
+		}
 	}
 	if err := manage.Register(db.name, table.Name, table); err != nil {
 		return nil, err
 	}
+	db.tablesMutex.Lock()
+	db.tables[table.Name] = table
+	db.tablesMutex.Unlock()
+	table.db = db
+	table.startVerifier()
 	return table, nil
 }
 
+// Remove stops caching the table, the Datas of the table are not updated any more.
 func (db *DB) Remove(table string) error {
 	manage.Unregister(db.name, table)
+	for _, t := range db.removeTables(table) {
+		if t.Polling != nil {
+			return db.poller.Unlisten(table)
+		}
+	}
 	return db.listener.Unlisten(table)
 }
 
+// Sync waits until the changes of the table committed before it have been applied to the Datas, so
+// the writes of the caller are visible when it returns (read-your-writes). It's not supported if
+// Options.ReplicationSlot is set.
+func (db *DB) Sync(ctx context.Context, table string) error {
+	db.tablesMutex.Lock()
+	t := db.tables[table]
+	db.tablesMutex.Unlock()
+	if t == nil {
+		return fmt.Errorf("pgcache: table %s.%s is not added.", db.name, table)
+	}
+	var listener Listener = db.listener
+	if t.Polling != nil {
+		listener = db.poller
+	}
+	syncer, ok := listener.(Syncer)
+	if !ok {
+		return errors.New("pgcache: Sync is not supported by the listener.")
+	}
+	return syncer.Sync(ctx, table)
+}
+
+// PruneChanges deletes the changes created before the time from "pgcache_changes" table.
+// It's used in ChangeLog mode.
+func (db *DB) PruneChanges(before time.Time) (int64, error) {
+	return pglistener.PruneChanges(db.dbQuerier.GetDB(), before)
+}
+
+// RemoveAll stops caching all the tables, tables can be added again after it. The listener and
+// its connection are kept for the tables added later, use Close to release them.
 func (db *DB) RemoveAll() error {
 	manage.UnregisterDB(db.name)
+	db.removeTables()
+	if err := db.poller.UnlistenAll(); err != nil {
+		return err
+	}
 	return db.listener.UnlistenAll()
 }
+
+// DropReplicationSlot drops the replication slot and its publication after Close.
+// It's used if Options.ReplicationSlot is set.
+func (db *DB) DropReplicationSlot(ctx context.Context) error {
+	listener, ok := db.listener.(*pglistener.ReplicationListener)
+	if !ok {
+		return errors.New("pgcache: ReplicationSlot is not set.")
+	}
+	return listener.DropSlot(ctx)
+}
+
+// Close stops caching all the tables, and releases the listener and its connection.
+// The DB can't be used any more after it.
+func (db *DB) Close(ctx context.Context) error {
+	manage.UnregisterDB(db.name)
+	db.removeTables()
+	if err := db.poller.Close(ctx); err != nil {
+		return err
+	}
+	return db.listener.Close(ctx)
+}
+
+// removeTables removes the tables and stops their verifiers, or all the tables if no table is
+// given. It returns the tables removed.
+func (db *DB) removeTables(tables ...string) []*Table {
+	db.tablesMutex.Lock()
+	var toStop []*Table
+	if len(tables) == 0 {
+		for _, t := range db.tables {
+			toStop = append(toStop, t)
+		}
+		db.tables = make(map[string]*Table)
+	} else {
+		for _, name := range tables {
+			if t := db.tables[name]; t != nil {
+				toStop = append(toStop, t)
+				delete(db.tables, name)
+			}
+		}
+	}
+	db.tablesMutex.Unlock()
+	for _, t := range toStop {
+		t.stopVerifier()
+	}
+	return toStop
+}
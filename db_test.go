@@ -1,6 +1,7 @@
 package pgcache_test
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"os"
@@ -61,13 +62,15 @@ func Example() {
 	fmt.Println(classesMap)
 
 	// even you insert some rows.
-	testInsert(studentsMap, classesMap)
+	testInsert(dbCache, studentsMap, classesMap)
 	// even you update some rows.
-	testUpdate(studentsMap, classesMap)
+	testUpdate(dbCache, studentsMap, classesMap)
 	// even you delete some rows.
-	testDelete(studentsMap, classesMap)
+	testDelete(dbCache, studentsMap, classesMap)
 
-	dbCache.RemoveAll()
+	if err := dbCache.Close(context.Background()); err != nil {
+		panic(err)
+	}
 
 	// Output:
 	// init:
@@ -103,7 +106,9 @@ VALUES
 	}
 }
 
-func testInsert(studentsMap map[int64]Student, classesMap map[string][]Student) {
+func testInsert(
+	dbCache *pgcache.DB, studentsMap map[int64]Student, classesMap map[string][]Student,
+) {
 	if _, err := testDB.Exec(`
 INSERT INTO students (id, name, class, updated_at)
 VALUES
@@ -112,29 +117,42 @@ VALUES
 `); err != nil {
 		panic(err)
 	}
-	time.Sleep(10 * time.Millisecond)
+	// wait until the changes are applied to the cache.
+	if err := dbCache.Sync(context.Background(), "students"); err != nil {
+		panic(err)
+	}
 	fmt.Println(`after INSERT:`)
 	fmt.Println(studentsMap)
 	fmt.Println(classesMap)
 }
 
-func testUpdate(studentsMap map[int64]Student, classesMap map[string][]Student) {
+func testUpdate(
+	dbCache *pgcache.DB, studentsMap map[int64]Student, classesMap map[string][]Student,
+) {
 	if _, err := testDB.Exec(
 		`UPDATE students SET "class" = '初三2班', updated_at = '2003-10-1 09:10:40+08:00'`,
 	); err != nil {
 		panic(err)
 	}
-	time.Sleep(10 * time.Millisecond)
+	// wait until the changes are applied to the cache.
+	if err := dbCache.Sync(context.Background(), "students"); err != nil {
+		panic(err)
+	}
 	fmt.Println(`after UPDATE:`)
 	fmt.Println(studentsMap)
 	fmt.Println(classesMap)
 }
 
-func testDelete(studentsMap map[int64]Student, classesMap map[string][]Student) {
+func testDelete(
+	dbCache *pgcache.DB, studentsMap map[int64]Student, classesMap map[string][]Student,
+) {
 	if _, err := testDB.Exec(`DELETE FROM students WHERE id in (3, 4)`); err != nil {
 		panic(err)
 	}
-	time.Sleep(10 * time.Millisecond)
+	// wait until the changes are applied to the cache.
+	if err := dbCache.Sync(context.Background(), "students"); err != nil {
+		panic(err)
+	}
 	fmt.Println(`after DELETE:`)
 	fmt.Println(studentsMap)
 	fmt.Println(classesMap)
@@ -180,16 +198,18 @@ func Example2() {
 	fmt.Println(studentsSlice)
 
 	// even you insert some rows.
-	testInsert(studentsMap, classesMap)
+	testInsert(dbCache, studentsMap, classesMap)
 	fmt.Println(studentsSlice)
 	// even you update some rows.
-	testUpdate(studentsMap, classesMap)
+	testUpdate(dbCache, studentsMap, classesMap)
 	fmt.Println(studentsSlice)
 	// even you delete some rows.
-	testDelete(studentsMap, classesMap)
+	testDelete(dbCache, studentsMap, classesMap)
 	fmt.Println(studentsSlice)
 
-	dbCache.RemoveAll()
+	if err := dbCache.Close(context.Background()); err != nil {
+		panic(err)
+	}
 
 	// Output:
 	// id,class,updated_at name
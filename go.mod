@@ -1,20 +1,37 @@
 module github.com/lovego/pgcache
 
-go 1.14
+go 1.19
 
 require (
+	github.com/google/btree v1.1.3
+	github.com/jackc/pgconn v1.10.1
+	github.com/jackc/pgproto3/v2 v2.1.1
 	github.com/lib/pq v1.10.3
 	github.com/lovego/bsql v0.1.6
 	github.com/lovego/errs v0.0.6
 	github.com/lovego/goa v0.3.1
 	github.com/lovego/logger v0.0.3
-	github.com/lovego/slice v0.0.9 // indirect
 	github.com/lovego/sorted_sets v0.0.2
 	github.com/lovego/struct_tag v0.0.3
 	github.com/lovego/structs v0.0.3
-	github.com/lovego/tracer v0.0.2 // indirect
 	github.com/lovego/value v0.0.6
+)
+
+require (
+	github.com/fatih/color v1.13.0 // indirect
+	github.com/jackc/chunkreader/v2 v2.0.1 // indirect
+	github.com/jackc/pgio v1.0.0 // indirect
+	github.com/jackc/pgpassfile v1.0.0 // indirect
+	github.com/jackc/pgservicefile v0.0.0-20200714003250-2b9c44734f2b // indirect
+	github.com/lovego/slice v0.0.9 // indirect
+	github.com/lovego/strs v0.0.2 // indirect
+	github.com/lovego/tracer v0.0.2 // indirect
 	github.com/mattn/go-colorable v0.1.11 // indirect
+	github.com/mattn/go-isatty v0.0.14 // indirect
+	github.com/mattn/go-runewidth v0.0.13 // indirect
+	github.com/rivo/uniseg v0.2.0 // indirect
 	github.com/shopspring/decimal v1.3.1 // indirect
+	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97 // indirect
 	golang.org/x/sys v0.0.0-20211029165221-6e7872819dc8 // indirect
+	golang.org/x/text v0.3.6 // indirect
 )
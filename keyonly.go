@@ -0,0 +1,125 @@
+package pgcache
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/lovego/bsql"
+)
+
+// Flush loads the rows of the primary keys notified in "KeyOnly" mode, and updates the Datas.
+// It's called by the listener after a burst of notifications.
+func (t *Table) Flush(table string) {
+	if !t.KeyOnly {
+		return
+	}
+	t.rowsMutex.Lock()
+	keys := t.pendingKeys
+	t.pendingKeys = nil
+	t.rowsMutex.Unlock()
+	if len(keys) == 0 {
+		return
+	}
+
+	var rows = reflect.New(reflect.SliceOf(t.rowStruct)).Elem()
+	if err := t.dbQuerier.Query(rows.Addr().Interface(), t.keyOnlyLoadSql(keys)); err != nil {
+		t.Error(err)
+		t.requeueKeys(keys)
+		return
+	}
+	var loaded = make(map[interface{}]reflect.Value, rows.Len())
+	for i := 0; i < rows.Len(); i++ {
+		row := rows.Index(i)
+		loaded[t.primaryKey(row)] = row
+	}
+
+	var changes []Change
+	t.datasMutex.RLock()
+	t.rowsMutex.Lock()
+	unlock := t.lockDatas()
+	for key, keyRow := range keys {
+		old, exists := t.rows[key]
+		if row, ok := loaded[key]; ok {
+			t.saveRow(row, true)
+			if exists {
+				changes = append(changes, Change{Action: "UPDATE", Old: old.Interface(), New: row.Interface()})
+			} else {
+				changes = append(changes, Change{Action: "INSERT", New: row.Interface()})
+			}
+		} else if exists {
+			t.removeRow(keyRow, true)
+			changes = append(changes, Change{Action: "DELETE", Old: old.Interface()})
+		}
+	}
+	unlock()
+	t.rowsMutex.Unlock()
+	t.datasMutex.RUnlock()
+
+	t.publish(changes...)
+}
+
+func (t *Table) addPendingKey(content []byte) {
+	var row = reflect.New(t.rowStruct).Elem()
+	if err := jsonUnmarshal(content, row); err != nil {
+		t.Error(err)
+		return
+	}
+	t.rowsMutex.Lock()
+	defer t.rowsMutex.Unlock()
+	if t.pendingKeys == nil {
+		t.pendingKeys = make(map[interface{}]reflect.Value)
+	}
+	t.pendingKeys[t.primaryKey(row)] = row
+}
+
+// requeueKeys puts back the keys failed to load, so they're loaded again by the next Flush.
+func (t *Table) requeueKeys(keys map[interface{}]reflect.Value) {
+	t.rowsMutex.Lock()
+	defer t.rowsMutex.Unlock()
+	if t.pendingKeys == nil {
+		t.pendingKeys = keys
+		return
+	}
+	for key, row := range keys {
+		if _, ok := t.pendingKeys[key]; !ok {
+			t.pendingKeys[key] = row
+		}
+	}
+}
+
+func (t *Table) keyOnlyLoadSql(keys map[interface{}]reflect.Value) string {
+	var tuples = make([]string, 0, len(keys))
+	for _, row := range keys {
+		var values = make([]string, len(t.PrimaryKeys))
+		for i, name := range t.PrimaryKeys {
+			values[i] = bsql.V(row.FieldByName(name).Interface())
+		}
+		tuples = append(tuples, "("+strings.Join(values, ",")+")")
+	}
+	sort.Strings(tuples)
+	return fmt.Sprintf("SELECT * FROM (%s) AS t WHERE (%s) IN (%s)",
+		t.LoadSql, t.primaryKeyColumns, strings.Join(tuples, ","))
+}
+
+// primaryKey returns the "PrimaryKeys" fields of the row as a comparable struct.
+func (t *Table) primaryKey(row reflect.Value) interface{} {
+	key := reflect.New(t.primaryKeyType).Elem()
+	for i, name := range t.PrimaryKeys {
+		key.Field(i).Set(row.FieldByName(name))
+	}
+	return key.Interface()
+}
+
+// notifyColumns returns the columns and check columns for the trigger.
+func (t *Table) notifyColumns() (string, string) {
+	if !t.KeyOnly {
+		return t.Columns, t.BigColumns
+	}
+	checkColumns := t.Columns
+	if t.BigColumns != "" {
+		checkColumns += "," + t.BigColumns
+	}
+	return t.primaryKeyColumns, checkColumns
+}
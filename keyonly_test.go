@@ -0,0 +1,117 @@
+package pgcache
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/lovego/logger"
+)
+
+type keyOnlyQuerier struct {
+	rows []Score
+	err  error
+}
+
+func (q *keyOnlyQuerier) Query(data interface{}, sql string, args ...interface{}) error {
+	fmt.Println(sql)
+	if q.err != nil {
+		return q.err
+	}
+	*data.(*[]Score) = q.rows
+	return nil
+}
+
+func (q *keyOnlyQuerier) GetDB() *sql.DB {
+	return nil
+}
+
+func ExampleTable_Flush() {
+	var m1 map[int]map[string]int
+	var m2 map[string][]int
+
+	var mutex sync.RWMutex
+	t := &Table{
+		Name:        "scores",
+		RowStruct:   Score{},
+		KeyOnly:     true,
+		PrimaryKeys: []string{"StudentId", "Subject"},
+		Datas: []*Data{
+			{RWMutex: &mutex, DataPtr: &m1, MapKeys: []string{"StudentId", "Subject"}, Value: "Score"},
+			{RWMutex: &mutex, DataPtr: &m2, MapKeys: []string{"Subject"}, Value: "Score"},
+		},
+	}
+	querier := &keyOnlyQuerier{rows: []Score{{StudentId: 1000, Subject: "语文", Score: 90}}}
+	if err := t.init("db", querier, testLogger); err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(t.notifyColumns())
+
+	t.Init("")
+	fmt.Println(m1, m2)
+
+	t.Create("", []byte(`{"student_id": 1001, "subject": "语文"}`))
+	t.Update("",
+		[]byte(`{"student_id": 1000, "subject": "语文"}`),
+		[]byte(`{"student_id": 1000, "subject": "语文"}`),
+	)
+	querier.rows = []Score{
+		{StudentId: 1000, Subject: "语文", Score: 91},
+		{StudentId: 1001, Subject: "语文", Score: 95},
+	}
+	t.Flush("")
+	fmt.Println(m1, m2)
+
+	t.Delete("", []byte(`{"student_id": 1000, "subject": "语文"}`))
+	querier.rows = nil
+	t.Flush("")
+	fmt.Println(m1, m2)
+
+	// Output:
+	// student_id,subject student_id,subject,score
+	// SELECT student_id,subject,score  FROM scores
+	// map[1000:map[语文:90]] map[语文:[90]]
+	// SELECT * FROM (SELECT student_id,subject,score  FROM scores) AS t WHERE (student_id,subject) IN ((1000,'语文'),(1001,'语文'))
+	// map[1000:map[语文:91] 1001:map[语文:95]] map[语文:[91 95]]
+	// SELECT * FROM (SELECT student_id,subject,score  FROM scores) AS t WHERE (student_id,subject) IN ((1000,'语文'))
+	// map[1000:map[] 1001:map[语文:95]] map[语文:[95]]
+}
+
+func ExampleTable_Flush_queryError() {
+	var m map[int]map[string]int
+	var mutex sync.RWMutex
+	t := &Table{
+		Name:        "scores",
+		RowStruct:   Score{},
+		KeyOnly:     true,
+		PrimaryKeys: []string{"StudentId", "Subject"},
+		Datas:       []*Data{{RWMutex: &mutex, DataPtr: &m, MapKeys: []string{"StudentId", "Subject"}, Value: "Score"}},
+	}
+	querier := &keyOnlyQuerier{}
+	if err := t.init("db", querier, logger.New(io.Discard)); err != nil {
+		fmt.Println(err)
+		return
+	}
+	t.Init("")
+
+	t.Create("", []byte(`{"student_id": 1001, "subject": "语文"}`))
+	querier.err = errors.New("connection refused")
+	t.Flush("")
+	fmt.Println(m)
+
+	// the keys failed to load are loaded by the next Flush.
+	querier.err = nil
+	querier.rows = []Score{{StudentId: 1001, Subject: "语文", Score: 95}}
+	t.Flush("")
+	fmt.Println(m)
+
+	// Output:
+	// SELECT student_id,subject,score  FROM scores
+	// SELECT * FROM (SELECT student_id,subject,score  FROM scores) AS t WHERE (student_id,subject) IN ((1001,'语文'))
+	// map[]
+	// SELECT * FROM (SELECT student_id,subject,score  FROM scores) AS t WHERE (student_id,subject) IN ((1001,'语文'))
+	// map[1001:map[语文:95]]
+}
@@ -0,0 +1,260 @@
+package pgcache
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/lovego/bsql"
+)
+
+// LazyMap is a map to cache the hot keys of a big table. A key is loaded from db when it's missed,
+// and the least recently used keys are evicted when the limits are exceeded. The notified changes
+// only update the keys which are resident. For example:
+//
+//	customers := pgcache.NewLazyMap[int64, Customer](
+//		pgcache.Data{MapKeys: []string{"Id"}}, pgcache.LazyOptions[Customer]{MaxEntries: 100000},
+//	)
+//	dbCache.Add(&pgcache.Table{
+//		Name: "customers", RowStruct: Customer{}, Datas: []*pgcache.Data{customers.Data()},
+//	})
+//	customer, ok, err := customers.Get(1)
+//
+// All the Datas of a table should be LazyMaps if one is, and the table is not loaded by "LoadSql"
+// as a whole, a reload just evicts all the keys.
+type LazyMap[K comparable, V any] struct {
+	mutex sync.RWMutex
+	m     map[K]V
+	data  *Data
+	table *Table
+	// V is a map or slice, which is updated in place, so it's copied before returned.
+	cloneValues bool
+
+	options LazyOptions[V]
+	// the resident keys, the most recently used one is at the front.
+	lru     *list.List
+	entries map[K]*list.Element
+	cost    int64
+	// the keys being loaded from db.
+	loading map[K]*lazyLoad
+}
+
+// LazyOptions limits the keys resident in a LazyMap.
+type LazyOptions[V any] struct {
+	// The max number of resident keys. If both MaxEntries and MaxCost are 0, it's 10000.
+	MaxEntries int
+	// The max total cost of the resident values, it's used with Cost.
+	MaxCost int64
+	// Cost returns the cost of a value, for example its approximate size in bytes.
+	Cost func(value V) int64
+}
+
+const defaultLazyMaxEntries = 10000
+
+type lazyEntry[K comparable] struct {
+	key  K
+	cost int64
+}
+
+type lazyLoad struct {
+	done chan struct{}
+	// the key is changed during loading, so the loaded value may be stale.
+	changed bool
+}
+
+// lazyStore is implemented by LazyMap, to keep only the resident keys in the Data.
+// The methods are called with the lock of the Data held.
+type lazyStore interface {
+	bind(t *Table) error
+	// resident reports whether the key is resident, the change of a key not resident is ignored.
+	resident(key reflect.Value) bool
+	// changed is called after the value of a resident key is saved or removed.
+	changed(key reflect.Value)
+	cleared()
+}
+
+// NewLazyMap creates a LazyMap. The fields of data describe how to store rows into the map as Data
+// does, except that DataPtr and RWMutex are set by NewLazyMap. MapKeys should have only one field.
+func NewLazyMap[K comparable, V any](data Data, options LazyOptions[V]) *LazyMap[K, V] {
+	if options.MaxEntries <= 0 && (options.MaxCost <= 0 || options.Cost == nil) {
+		options.MaxEntries = defaultLazyMaxEntries
+	}
+	m := &LazyMap[K, V]{
+		m: make(map[K]V), options: options,
+		lru: list.New(), entries: make(map[K]*list.Element), loading: make(map[K]*lazyLoad),
+	}
+	data.DataPtr = &m.m
+	data.RWMutex = &m.mutex
+	data.lazy = m
+	m.data = &data
+	switch reflect.TypeOf(&m.m).Elem().Elem().Kind() {
+	case reflect.Map, reflect.Slice:
+		m.cloneValues = true
+	}
+	return m
+}
+
+// Data returns the Data to put into Table.Datas.
+func (m *LazyMap[K, V]) Data() *Data {
+	return m.data
+}
+
+// Get returns the value of the key, and whether it exists. If the key is not resident, it's loaded
+// from db by the "MapKeys" column. A key not existing in db is also resident until it's evicted.
+func (m *LazyMap[K, V]) Get(key K) (V, bool, error) {
+	var value V
+	var ok bool
+	var err error
+	for i := 0; i < 3; i++ {
+		m.mutex.Lock()
+		if elem := m.entries[key]; elem != nil {
+			m.lru.MoveToFront(elem)
+			value, ok = m.m[key]
+			m.mutex.Unlock()
+			return m.clone(value), ok, nil
+		}
+		if load := m.loading[key]; load != nil {
+			m.mutex.Unlock()
+			<-load.done
+			continue
+		}
+		load := &lazyLoad{done: make(chan struct{})}
+		m.loading[key] = load
+		m.mutex.Unlock()
+
+		value, ok, err = m.load(key)
+
+		m.mutex.Lock()
+		delete(m.loading, key)
+		close(load.done)
+		if err == nil && !load.changed {
+			// a key not existing is also resident, so it's not loaded again until it's inserted.
+			if ok {
+				m.m[key] = value
+				value = m.clone(value)
+			}
+			m.entries[key] = m.lru.PushFront(&lazyEntry[K]{key: key})
+			m.updateCost(key)
+			m.mutex.Unlock()
+			return value, ok, nil
+		}
+		m.mutex.Unlock()
+		if err != nil {
+			return value, false, err
+		}
+	}
+	// the key is changed frequently, return the last loaded value without caching it.
+	return m.clone(value), ok, nil
+}
+
+// load the value of a key from db.
+func (m *LazyMap[K, V]) load(key K) (V, bool, error) {
+	var value V
+	t := m.table
+	if t == nil {
+		return value, false, errors.New("LazyMap is not added to a table.")
+	}
+	var rows = reflect.New(reflect.SliceOf(t.rowStruct)).Elem()
+	if err := t.dbQuerier.Query(rows.Addr().Interface(), fmt.Sprintf(
+		"SELECT * FROM (%s) AS t WHERE %s = %s",
+		t.LoadSql, Field2Column(m.data.MapKeys[0]), bsql.V(key),
+	)); err != nil {
+		return value, false, fmt.Errorf("pgcache (%s.%s) load: %v", t.dbName, t.Name, err)
+	}
+	container := m.data.build(rows).Interface().(map[K]V)
+	value, ok := container[key]
+	return value, ok, nil
+}
+
+// Len returns the number of resident keys which exist.
+func (m *LazyMap[K, V]) Len() int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return len(m.m)
+}
+
+// Evict removes the key from the map, it's loaded from db again when it's got.
+func (m *LazyMap[K, V]) Evict(key K) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.evict(key)
+}
+
+func (m *LazyMap[K, V]) clone(value V) V {
+	if m.cloneValues {
+		return cloneContainer(reflect.ValueOf(value)).Interface().(V)
+	}
+	return value
+}
+
+func (m *LazyMap[K, V]) evict(key K) {
+	if elem := m.entries[key]; elem != nil {
+		m.cost -= elem.Value.(*lazyEntry[K]).cost
+		m.lru.Remove(elem)
+		delete(m.entries, key)
+	}
+	delete(m.m, key)
+}
+
+// updateCost updates the cost of a resident key, and evicts the least recently used keys if the
+// limits are exceeded. The key itself is not evicted.
+func (m *LazyMap[K, V]) updateCost(key K) {
+	if m.options.Cost != nil {
+		entry := m.entries[key].Value.(*lazyEntry[K])
+		var cost int64
+		if value, ok := m.m[key]; ok {
+			cost = m.options.Cost(value)
+		}
+		m.cost += cost - entry.cost
+		entry.cost = cost
+	}
+	for m.lru.Len() > 1 && (m.options.MaxEntries > 0 && m.lru.Len() > m.options.MaxEntries ||
+		m.options.MaxCost > 0 && m.cost > m.options.MaxCost) {
+		oldest := m.lru.Back().Value.(*lazyEntry[K]).key
+		if oldest == key {
+			break
+		}
+		m.evict(oldest)
+	}
+}
+
+func (m *LazyMap[K, V]) bind(t *Table) error {
+	if key := m.data.mapKeys[0]; len(m.data.MapKeys) != 1 || key.keyType != nil || key.multi {
+		return errors.New("LazyMap: Data.MapKeys should have only one field.")
+	}
+	m.table = t
+	return nil
+}
+
+func (m *LazyMap[K, V]) resident(keyV reflect.Value) bool {
+	key := m.key(keyV)
+	if m.entries[key] != nil {
+		return true
+	}
+	if load := m.loading[key]; load != nil {
+		load.changed = true
+	}
+	return false
+}
+
+func (m *LazyMap[K, V]) changed(keyV reflect.Value) {
+	// the key stays resident even if its last row is removed, so a later insert is kept.
+	m.updateCost(m.key(keyV))
+}
+
+func (m *LazyMap[K, V]) cleared() {
+	m.lru.Init()
+	m.entries = make(map[K]*list.Element)
+	m.cost = 0
+	for _, load := range m.loading {
+		load.changed = true
+	}
+}
+
+func (m *LazyMap[K, V]) key(keyV reflect.Value) K {
+	var key K
+	reflect.ValueOf(&key).Elem().Set(keyV)
+	return key
+}
@@ -0,0 +1,71 @@
+package pgcache
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+type lazyQuerier struct {
+	queries *[]string
+}
+
+func (q lazyQuerier) Query(data interface{}, sql string, args ...interface{}) error {
+	*q.queries = append(*q.queries, sql[strings.Index(sql, "WHERE"):])
+	rows := data.(*[]Score)
+	for _, row := range []Score{
+		{StudentId: 1001, Subject: "语文", Score: 90},
+		{StudentId: 1002, Subject: "语文", Score: 80},
+		{StudentId: 1003, Subject: "语文", Score: 70},
+	} {
+		if strings.HasSuffix(sql, fmt.Sprint(row.StudentId)) {
+			*rows = append(*rows, row)
+		}
+	}
+	return nil
+}
+
+func (q lazyQuerier) GetDB() *sql.DB {
+	return nil
+}
+
+func ExampleNewLazyMap() {
+	var queries []string
+	m := NewLazyMap[int, Score](Data{MapKeys: []string{"StudentId"}}, LazyOptions[Score]{MaxEntries: 2})
+	t := &Table{Name: "scores", RowStruct: Score{}, Datas: []*Data{m.Data()}}
+	if err := t.init("db", lazyQuerier{&queries}, testLogger); err != nil {
+		panic(err)
+	}
+	t.Init("")
+
+	fmt.Println(m.Get(1001))
+	fmt.Println(m.Get(1001)) // resident
+	fmt.Println(m.Get(1004)) // not existing, but resident
+	fmt.Println(m.Get(1004))
+
+	// only the resident keys are updated.
+	t.Create("", []byte(`{"StudentId": 1004, "Subject": "数学", "Score": 60}`))
+	t.Update("",
+		[]byte(`{"StudentId": 1002, "Subject": "语文", "Score": 80}`),
+		[]byte(`{"StudentId": 1002, "Subject": "语文", "Score": 85}`),
+	)
+	fmt.Println(m.Len())
+	fmt.Println(m.Get(1004))
+
+	fmt.Println(m.Get(1002)) // 1001 is evicted
+	fmt.Println(m.Len(), queries)
+
+	t.Reload() // evicts all the keys.
+	fmt.Println(m.Len())
+
+	// Output:
+	// {1001 语文 90} true <nil>
+	// {1001 语文 90} true <nil>
+	// {0  0} false <nil>
+	// {0  0} false <nil>
+	// 2
+	// {1004 数学 60} true <nil>
+	// {1002 语文 80} true <nil>
+	// 2 [WHERE student_id = 1001 WHERE student_id = 1004 WHERE student_id = 1002]
+	// 0
+}
@@ -3,6 +3,7 @@ package manage
 import (
 	"bytes"
 	"fmt"
+	"html"
 	"os"
 	"sort"
 )
@@ -62,10 +63,17 @@ func listDbTable(buf *bytes.Buffer, db, table string, cache Cache) int {
 
 	var reload string
 	if _, ok := cache.(interface {
-		Reload(noClear bool) error
+		Reload() error
 	}); ok {
 		reload = fmt.Sprintf(`<a href="./caches/%s/%s/reload">reload</a>`, db, table)
 	}
+	if verify, ok := cache.(interface {
+		VerifyStatus() string
+	}); ok {
+		if status := verify.VerifyStatus(); status != "" {
+			reload += "<br>" + html.EscapeString(status)
+		}
+	}
 
 	buf.WriteString(fmt.Sprintf(`<td%s>%s</td>
 %s
@@ -19,6 +19,7 @@ input:focus { outline-width: 0; }
     <p>` + hostName + `</p>
     <p>To see a spefic value in data, click at blank area after data link to show input box(click again to hide it).
     Input map keys or slice indexes seperated by "," and press ENTER.
+    The fields of a composite map key are seperated by "|".
     </p>
     ` + table + `
     <script>
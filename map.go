@@ -0,0 +1,108 @@
+package pgcache
+
+import (
+	"reflect"
+	"sync"
+)
+
+// Map is a map to cache table rows, which owns its lock, so readers can't forget to lock it.
+// Use Map.Data as an element of Table.Datas to keep it up to date, for example:
+//
+//	students := pgcache.NewMap[int64, Student](pgcache.Data{MapKeys: []string{"Id"}})
+//	dbCache.Add(&pgcache.Table{
+//		Name: "students", RowStruct: Student{}, Datas: []*pgcache.Data{students.Data()},
+//	})
+//	student, ok := students.Get(1)
+type Map[K comparable, V any] struct {
+	mutex sync.RWMutex
+	m     map[K]V
+	data  *Data
+	// V is a map or slice, which is updated in place, so it's copied before returned.
+	cloneValues bool
+}
+
+// NewMap creates a Map. The fields of data describe how to store rows into the map as Data does,
+// except that DataPtr and RWMutex are set by NewMap.
+func NewMap[K comparable, V any](data Data) *Map[K, V] {
+	m := &Map[K, V]{m: make(map[K]V)}
+	data.DataPtr = &m.m
+	data.RWMutex = &m.mutex
+	m.data = &data
+	switch reflect.TypeOf(&m.m).Elem().Elem().Kind() {
+	case reflect.Map, reflect.Slice:
+		m.cloneValues = true
+	}
+	return m
+}
+
+// Data returns the Data to put into Table.Datas.
+func (m *Map[K, V]) Data() *Data {
+	return m.data
+}
+
+// Get returns the value of the key, and whether it exists.
+func (m *Map[K, V]) Get(key K) (V, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	value, ok := m.m[key]
+	if ok && m.cloneValues {
+		value = cloneContainer(reflect.ValueOf(value)).Interface().(V)
+	}
+	return value, ok
+}
+
+// Range calls f for each key and value in the map until f returns false. The read lock is held
+// during Range, so f should be fast and must not retain a map or slice value.
+func (m *Map[K, V]) Range(f func(key K, value V) bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	for key, value := range m.m {
+		if !f(key, value) {
+			return
+		}
+	}
+}
+
+// Len returns the number of keys in the map.
+func (m *Map[K, V]) Len() int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return len(m.m)
+}
+
+// Snapshot returns a copy of the map, which is not changed by the later updates.
+func (m *Map[K, V]) Snapshot() map[K]V {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var result = make(map[K]V, len(m.m))
+	for key, value := range m.m {
+		if m.cloneValues {
+			value = cloneContainer(reflect.ValueOf(value)).Interface().(V)
+		}
+		result[key] = value
+	}
+	return result
+}
+
+// cloneContainer copies the maps and slices of v recursively, the other values are shared.
+func cloneContainer(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for iter := v.MapRange(); iter.Next(); {
+			c.SetMapIndex(iter.Key(), cloneContainer(iter.Value()))
+		}
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(c, v)
+		return c
+	}
+	return v
+}
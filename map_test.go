@@ -0,0 +1,56 @@
+package pgcache
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+func ExampleNewMap() {
+	m := NewMap[int, Score](Data{MapKeys: []string{"StudentId"}, Precond: "Valid"})
+	if err := m.Data().init(reflect.TypeOf(Score{})); err != nil {
+		panic(err)
+	}
+	rows := reflect.ValueOf([]Score{
+		{StudentId: 1001, Score: 98},
+		{StudentId: 1002, Score: 101},
+		{StudentId: 1003, Score: -1},
+	})
+	for i := 0; i < rows.Len(); i++ {
+		m.Data().save(rows.Index(i))
+	}
+	fmt.Println(m.Get(1001))
+	fmt.Println(m.Get(1003))
+	fmt.Println(m.Len(), m.Snapshot())
+
+	var keys []int
+	m.Range(func(key int, value Score) bool {
+		keys = append(keys, key)
+		return true
+	})
+	sort.Ints(keys)
+	fmt.Println(keys)
+	// Output:
+	// {1001  98} true
+	// {0  0} false
+	// 2 map[1001:{1001  98} 1002:{1002  101}]
+	// [1001 1002]
+}
+
+func ExampleNewMap_sortedSets() {
+	m := NewMap[int, []int](Data{MapKeys: []string{"StudentId"}, Value: "Score"})
+	if err := m.Data().init(reflect.TypeOf(Score{})); err != nil {
+		panic(err)
+	}
+	m.Data().save(reflect.ValueOf(Score{StudentId: 1001, Score: 98}))
+	scores, _ := m.Get(1001)
+	snapshot := m.Snapshot()
+
+	// the values got before are not changed by the later updates.
+	m.Data().save(reflect.ValueOf(Score{StudentId: 1001, Score: 90}))
+	fmt.Println(scores, snapshot)
+	fmt.Println(m.Get(1001))
+	// Output:
+	// [98] map[1001:[98]]
+	// [90 98] true
+}
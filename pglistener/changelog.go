@@ -0,0 +1,237 @@
+package pglistener
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/lovego/errs"
+)
+
+// Changes may be committed in an order different from their ids, so the changes whose id is
+// within this window below the last applied id are also replayed, unless they are applied.
+const replayWindow = 1000
+
+// the change log state of a table.
+type changeLog struct {
+	// the max id applied.
+	lastId int64
+	// the ids applied which are greater than "lastId - replayWindow".
+	applied map[int64]bool
+}
+
+// apply reports whether the change of the id should be applied, and marks it as applied.
+func (c *changeLog) apply(id int64) bool {
+	if c == nil || id <= 0 {
+		return true
+	}
+	if id <= c.lastId-replayWindow || c.applied[id] {
+		return false
+	}
+	c.applied[id] = true
+	if id > c.lastId {
+		c.lastId = id
+	}
+	if len(c.applied) > 2*replayWindow {
+		for id := range c.applied {
+			if id <= c.lastId-replayWindow {
+				delete(c.applied, id)
+			}
+		}
+	}
+	return true
+}
+
+var errChangesPruned = errors.New("pglistener: the changes to replay have been pruned.")
+
+// Resumer is optionally implemented by a Handler in ChangeLog mode. If so, the handler can restore
+// the table from a position saved earlier instead of Init, then the changes after it are replayed.
+type Resumer interface {
+	// Resume restores the table and returns the id in "pgcache_changes" table it's restored to.
+	// If ok is false, Init is called instead.
+	Resume(table string) (position int64, ok bool)
+	// Position is called with the id in "pgcache_changes" table which the table is updated to.
+	Position(table string, position int64)
+}
+
+// initTable resumes the table if the handler is a Resumer, otherwise calls Handler.Init.
+func (w *worker) initTable(table string, handler Handler) {
+	if !w.options.ChangeLog {
+		handler.Init(table)
+		return
+	}
+	if resumer, ok := handler.(Resumer); ok {
+		if position, ok := resumer.Resume(table); ok {
+			w.changeLogs[table] = &changeLog{lastId: position, applied: make(map[int64]bool)}
+			err := w.replayChanges(table, handler)
+			if err == nil {
+				w.reportPosition(table, handler)
+				return
+			}
+			if err != errChangesPruned {
+				w.logger.Error(err)
+			}
+		}
+	}
+	w.initChangeLog(table)
+	handler.Init(table)
+	w.reportPosition(table, handler)
+}
+
+// reportPosition reports the position of the table to the handler if it's a Resumer.
+// A table with a buffered transaction is not reported, because its changes are not applied yet.
+func (w *worker) reportPosition(table string, handler Handler) {
+	resumer, ok := handler.(Resumer)
+	if !ok || w.txs[table] != nil {
+		return
+	}
+	if log := w.changeLogs[table]; log != nil {
+		resumer.Position(table, log.lastId)
+	}
+}
+
+func (w *worker) initChangeLog(table string) {
+	lastId, err := maxChangeId(w.db)
+	if err != nil {
+		w.logger.Error(err)
+	}
+	w.changeLogs[table] = &changeLog{lastId: lastId, applied: make(map[int64]bool)}
+}
+
+// replay the changes of a table missed during a connection loss.
+// If the changes have been pruned, Handler.ConnLoss is called.
+func (w *worker) replay(table string, handler Handler) {
+	err := w.replayChanges(table, handler)
+	if err == nil {
+		w.reportPosition(table, handler)
+		return
+	}
+	if err != errChangesPruned {
+		w.logger.Error(err)
+	}
+	w.initChangeLog(table)
+	handler.ConnLoss(table)
+	w.reportPosition(table, handler)
+}
+
+func (w *worker) replayChanges(table string, handler Handler) error {
+	log := w.changeLogs[table]
+	if log == nil {
+		return errChangesPruned
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var prunedId int64
+	if err := w.db.QueryRowContext(ctx,
+		`SELECT coalesce(max(id), 0) FROM pgcache_changes_pruned`,
+	).Scan(&prunedId); err != nil {
+		return errs.Trace(err)
+	}
+	// the changes after "lastId" must not have been pruned. The window is shortened by pruning,
+	// the changes pruned are old enough to have been committed and applied before "lastId".
+	if prunedId > log.lastId {
+		return errChangesPruned
+	}
+	from := log.lastId - replayWindow
+	if prunedId > from {
+		from = prunedId
+	}
+
+	rows, err := w.db.QueryContext(ctx, `SELECT id, payload FROM pgcache_changes
+WHERE channel = $1 AND id > $2 ORDER BY id`, w.GetChannel(table), from)
+	if err != nil {
+		return errs.Trace(err)
+	}
+	defer rows.Close()
+	var changed bool
+	for rows.Next() {
+		var id int64
+		var payload []byte
+		if err := rows.Scan(&id, &payload); err != nil {
+			return errs.Trace(err)
+		}
+		var msg message
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			w.logger.Error(err)
+			continue
+		}
+		msg.Id = id // the payload in table has no id.
+		if w.dispatchMessage(table, handler, msg) {
+			changed = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return errs.Trace(err)
+	}
+	// no end marker is logged, so end the last transaction replayed.
+	if w.endTx(table, handler) {
+		changed = true
+	}
+	if flusher, ok := handler.(Flusher); ok && changed {
+		flusher.Flush(table)
+	}
+	return nil
+}
+
+// PruneChanges deletes the changes created before the time from "pgcache_changes" table.
+// If a listener has missed some of these changes, it calls Handler.ConnLoss instead of replaying.
+func PruneChanges(db *sql.DB, before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var count int64
+	if err := db.QueryRowContext(ctx, `
+WITH deleted AS (
+  DELETE FROM pgcache_changes WHERE created_at < $1 RETURNING id
+), pruned AS (
+  UPDATE pgcache_changes_pruned SET id = greatest(id, (SELECT max(id) FROM deleted))
+  WHERE EXISTS (SELECT 1 FROM deleted)
+)
+SELECT count(*) FROM deleted`, before,
+	).Scan(&count); err != nil {
+		return 0, errs.Trace(err)
+	}
+	return count, nil
+}
+
+// PruneChanges deletes the changes created before the time from "pgcache_changes" table.
+func (l *Listener) PruneChanges(before time.Time) (int64, error) {
+	return PruneChanges(l.db, before)
+}
+
+func maxChangeId(db *sql.DB) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var id int64
+	if err := db.QueryRowContext(ctx,
+		`SELECT coalesce(max(id), 0) FROM pgcache_changes`,
+	).Scan(&id); err != nil {
+		return 0, errs.Trace(err)
+	}
+	return id, nil
+}
+
+func createChangeLogTable(db *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, `
+CREATE TABLE IF NOT EXISTS pgcache_changes (
+  id         bigserial   NOT NULL PRIMARY KEY,
+  channel    text        NOT NULL,
+  payload    jsonb       NOT NULL,
+  created_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS pgcache_changes_channel_id ON pgcache_changes (channel, id);
+CREATE INDEX IF NOT EXISTS pgcache_changes_created_at ON pgcache_changes (created_at);
+CREATE TABLE IF NOT EXISTS pgcache_changes_pruned (
+  id bigint NOT NULL
+);
+INSERT INTO pgcache_changes_pruned (id)
+SELECT 0 WHERE NOT EXISTS (SELECT 1 FROM pgcache_changes_pruned);
+`); err != nil {
+		return errs.Trace(err)
+	}
+	return nil
+}
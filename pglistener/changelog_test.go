@@ -0,0 +1,19 @@
+package pglistener
+
+import "fmt"
+
+func Example_changeLogApply() {
+	c := &changeLog{lastId: 2000, applied: make(map[int64]bool)}
+	fmt.Println(c.apply(2001), c.apply(2001), c.lastId)
+	// committed later than 2001, but still in the replay window.
+	fmt.Println(c.apply(1500), c.apply(1500), c.lastId)
+	// out of the replay window.
+	fmt.Println(c.apply(1000))
+	// no id, not in ChangeLog mode.
+	fmt.Println(c.apply(0))
+	// Output:
+	// true false 2001
+	// true false 2001
+	// false
+	// true
+}
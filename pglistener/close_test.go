@@ -0,0 +1,73 @@
+package pglistener
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/lib/pq"
+	loggerPkg "github.com/lovego/logger"
+)
+
+type closeTestHandler struct {
+	Handler
+	changed chan string
+}
+
+func (h closeTestHandler) Init(table string) {
+	fmt.Println("Init", table)
+}
+
+func (h closeTestHandler) Create(table string, content []byte) {
+	h.changed <- fmt.Sprint("Create ", table, " ", string(content))
+}
+
+func ExampleListener_Close() {
+	l := &Listener{
+		logger:   loggerPkg.New(os.Stderr),
+		listener: pq.NewListener("postgres://localhost:1/none", time.Second, time.Minute, nil),
+		handlers: make(map[string]Handler),
+		inited:   make(map[string]chan struct{}),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+		workers:  make(map[string]*worker),
+	}
+	go l.loop()
+
+	h := closeTestHandler{changed: make(chan string)}
+	inited := make(chan struct{})
+	l.handlers["public.t"] = h
+	l.inited["public.t"] = inited
+	fmt.Println(l.notify("public.t", "init"))
+	<-inited
+	fmt.Println(l.notify("public.t", `{"action":"INSERT","new":{"id":1}}`))
+	fmt.Println(<-h.changed)
+
+	fmt.Println(l.unlisten("public.t"), l.tables())
+	fmt.Println(l.Close(context.Background()))
+	fmt.Println(l.notify("public.t", "init"))
+	// Output:
+	// <nil>
+	// Init public.t
+	// <nil>
+	// Create public.t {"id":1}
+	// <nil> []
+	// <nil>
+	// pglistener: listener is closed.
+}
+
+type connLossTestHandler struct {
+	Handler
+}
+
+func (h connLossTestHandler) ConnLoss(table string) {
+	fmt.Println("ConnLoss", table)
+}
+
+func Example_truncate() {
+	// ConnLoss is called if the handler doesn't implement Truncater.
+	truncate("public.t", connLossTestHandler{})
+	// Output:
+	// ConnLoss public.t
+}
@@ -7,22 +7,78 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/lib/pq"
 	"github.com/lovego/errs"
 )
 
-// Listen for INSERT/UPDATE/DELETE events of postgresql's table,
+// Listen for INSERT/UPDATE/DELETE/TRUNCATE events of postgresql's table,
 // and pass the events to defined handlers.
 type Listener struct {
 	db       *sql.DB // db to create func and triggers
 	listener *pq.Listener
 	logger   Logger
+	options  Options
+
+	mutex    sync.Mutex // protect handlers and inited
 	handlers map[string]Handler
 	inited   map[string]chan struct{}
+
+	// held by the senders to listener.Notify, so it's not closed by Close during sending.
+	notifyMutex sync.RWMutex
+	closed      bool
+	// closing is closed to stop the loop, and done is closed after the loop stopped.
+	closing, done chan struct{}
+
+	// the workers of tables, only accessed by the loop goroutine.
+	workers map[string]*worker
+	// the shared worker of all tables, only used in SingleWorker mode.
+	sharedWorker *worker
+	// wait for the workers to stop.
+	workersWait sync.WaitGroup
+
+	syncs syncs
+}
+
+type Options struct {
+	// Consumer is the name of the application which consumes the notifications. It's used to derive
+	// the names of triggers and channels, so multiple applications can listen the same table with
+	// different columns. It should consist of lower case letters, digits and underscores.
+	Consumer string
+	// If ChangeLog is true, the changes are also inserted into the "pgcache_changes" table, so the
+	// changes missed during a connection loss are replayed instead of calling Handler.ConnLoss.
+	// Handler.ConnLoss is called only if the changes have been pruned by PruneChanges.
+	ChangeLog bool
+	// If Transactional is true, the notifications carry the transaction id, and the changes of a
+	// transaction are buffered until the transaction's end marker arrives, then passed to the
+	// handler together. See TxHandler.
+	Transactional bool
+	// A transaction without the end marker (such as consisting only of TRUNCATE) is regarded as
+	// ended, if no new notification arrives within TxEndTimeout, 100ms by default. It should be
+	// longer than the delay between the notifications of a transaction in a busy database.
+	TxEndTimeout time.Duration
+	// If StatementLevel is true, statement level triggers with transition tables (PostgreSQL 10+)
+	// are used instead of row level triggers, so a statement changing many rows sends only one
+	// notification. If the rows changed by a statement exceed BulkThreshold or the payload limit,
+	// only the count is notified, and BulkHandler.BulkChange is called.
+	StatementLevel bool
+	// The max number of rows notified by a statement in StatementLevel mode, 1000 by default.
+	BulkThreshold int
+	// If DropTriggers is true, the triggers of a table are dropped when it's unlistened or the
+	// listener is closed. Don't use it if other processes of the same consumer listen the table.
+	DropTriggers bool
+	// Workers is the policy to dispatch the notifications to handlers, SingleWorker by default.
+	Workers WorkerPolicy
+	// The max number of notifications queued for a worker, 1000 by default. In TableWorkers mode,
+	// if the queue of a table is full, the notifications are dropped, and the table is handled as a
+	// connection loss after the queue is drained, so the other tables are not blocked.
+	QueueSize int
 }
 
 type Handler interface {
@@ -33,32 +89,90 @@ type Handler interface {
 	ConnLoss(table string)
 }
 
+// Truncater is optionally implemented by a Handler. If so, Truncate is called when the table is
+// truncated, otherwise ConnLoss is called, so the handler reloads the table.
+type Truncater interface {
+	Truncate(table string)
+}
+
+// Flusher is optionally implemented by a Handler. If so, Flush is called after a burst of
+// notifications of the table are handled, so the handler can process them in batch.
+type Flusher interface {
+	Flush(table string)
+}
+
+var errClosed = errors.New("pglistener: listener is closed.")
+
+// the consumer name is limited, so the trigger names derived from it are not truncated.
+var consumerRegexp = regexp.MustCompile(`^[a-z0-9_]{1,30}$`)
+
+// the max length of postgresql's identifiers, pg_notify fails on a longer channel name.
+const maxIdentifierLength = 63
+
+// the max number of notifications handled in a burst before Flush is called.
+const maxBurstSize = 1000
+
 type Logger interface {
 	Error(args ...interface{})
 	Errorf(format string, args ...interface{})
 }
 
+// InfoLogger is optionally implemented by a Logger. If so, the informational messages are logged
+// by Infof, otherwise they're logged by Errorf.
+type InfoLogger interface {
+	Infof(format string, args ...interface{})
+}
+
+func infof(logger Logger, format string, args ...interface{}) {
+	if infoLogger, ok := logger.(InfoLogger); ok {
+		infoLogger.Infof(format, args...)
+	} else {
+		logger.Errorf(format, args...)
+	}
+}
+
 type message struct {
+	Id     int64 // the id in "pgcache_changes" table, only present in ChangeLog mode.
+	Txid   int64 // the transaction id, only present in Transactional mode.
+	Seq    int   // the sequence in the transaction, only present in Transactional mode.
 	Action string
+	Op     string // the statement of a BATCH or BULK action, only present in StatementLevel mode.
+	Rows   int64  // the number of rows changed of a BULK action.
 	Old    json.RawMessage
 	New    json.RawMessage
 }
 
 func New(dbAddr string, db *sql.DB, logger Logger) (*Listener, error) {
+	return NewWithOptions(dbAddr, db, logger, Options{})
+}
+
+func NewWithOptions(dbAddr string, db *sql.DB, logger Logger, options Options) (*Listener, error) {
+	if options.Consumer != "" && !consumerRegexp.MatchString(options.Consumer) {
+		return nil, fmt.Errorf("pglistener: invalid consumer name: '%s'", options.Consumer)
+	}
 	if db == nil {
 		var err error
 		if db, err = getDb(dbAddr); err != nil {
 			return nil, err
 		}
 	}
+	if options.ChangeLog {
+		if err := createChangeLogTable(db); err != nil {
+			return nil, err
+		}
+	}
 	if err := createPGFunction(db); err != nil {
 		return nil, err
 	}
 	l := &Listener{
 		db:       db,
 		logger:   logger,
+		options:  options,
 		handlers: make(map[string]Handler),
 		inited:   make(map[string]chan struct{}),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+		workers:  make(map[string]*worker),
 	}
 	l.listener = pq.NewListener(dbAddr, time.Second, time.Minute, l.eventLogger)
 	go l.loop()
@@ -71,22 +185,43 @@ func (l *Listener) Listen(table string, columns, checkColumns string, handler Ha
 	if strings.IndexByte(table, '.') < 0 {
 		table = "public." + table
 	}
+	if channel := l.GetChannel(table); len(channel) > maxIdentifierLength {
+		return fmt.Errorf("pglistener: channel name '%s' is longer than %d bytes.",
+			channel, maxIdentifierLength)
+	}
+	l.mutex.Lock()
 	if _, ok := l.handlers[table]; ok {
+		l.mutex.Unlock()
 		return fmt.Errorf("pglistener: table '%s' is aready listened.", table)
 	}
-	if err := createTrigger(l.db, table, columns, checkColumns); err != nil {
+	inited := make(chan struct{})
+	l.handlers[table] = handler
+	l.inited[table] = inited
+	l.mutex.Unlock()
+
+	if err := l.listen(table, columns, checkColumns); err != nil {
+		l.removeHandler(table)
+		return err
+	}
+	select {
+	case <-inited:
+		return nil
+	case <-l.done:
+		return errClosed
+	}
+}
+
+func (l *Listener) listen(table string, columns, checkColumns string) error {
+	if err := createTrigger(l.db, l.logger, table, columns, checkColumns, l.options); err != nil {
 		return err
 	}
-	l.handlers[table] = handler
-	l.inited[table] = make(chan struct{})
 	if err := l.listener.Listen(l.GetChannel(table)); err != nil {
 		return errs.Trace(err)
 	}
-	l.listener.Notify <- &pq.Notification{Channel: l.GetChannel(table), Extra: "init"}
-	<-l.inited[table]
-	return nil
+	return l.notify(table, "init")
 }
 
+// Unlisten a table, the handler of the table is not notified any more.
 func (l *Listener) Unlisten(table string) error {
 	if strings.IndexByte(table, '.') < 0 {
 		table = "public." + table
@@ -94,51 +229,105 @@ func (l *Listener) Unlisten(table string) error {
 	if err := l.listener.Unlisten(l.GetChannel(table)); err != nil {
 		return errs.Trace(err)
 	}
-	return nil
+	return l.unlisten(table)
 }
 
+// UnlistenAll unlistens all the tables. The loop and the connection are kept for the tables
+// listened later, use Close to release them.
 func (l *Listener) UnlistenAll() error {
 	if err := l.listener.UnlistenAll(); err != nil {
 		return errs.Trace(err)
 	}
+	for _, table := range l.tables() {
+		if err := l.unlisten(table); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (l *Listener) loop() {
-	for {
-		select {
-		case notice := <-l.listener.Notify:
-			l.handle(notice)
-		case <-time.After(time.Minute):
-			go l.listener.Ping()
-		}
+func (l *Listener) unlisten(table string) error {
+	l.removeHandler(table)
+	// the state of the table in the loop is cleared after the notifications already arrived.
+	if err := l.notify(table, "unlisten"); err != nil {
+		return err
+	}
+	if l.options.DropTriggers {
+		return dropExistingTrigger(context.Background(), l.db, table, l.options.Consumer)
 	}
+	return nil
 }
 
-func (l *Listener) handle(notice *pq.Notification) {
-	if notice == nil { // connection loss
-		for table, handler := range l.handlers {
-			handler.ConnLoss(table)
-		}
-		return
+// Close stops the loop and closes the connection of the listener, the handlers are not notified
+// any more after it returns. If Options.DropTriggers is true, the triggers of the listened tables
+// are dropped. If ctx is done before the handling notification finished, ctx.Err() is returned.
+func (l *Listener) Close(ctx context.Context) error {
+	l.notifyMutex.Lock()
+	if l.closed {
+		l.notifyMutex.Unlock()
+		return nil
 	}
+	l.closed = true
+	l.notifyMutex.Unlock()
 
-	var table = l.GetTable(notice.Channel)
-	handler := l.handlers[table]
-	if handler == nil {
-		l.logger.Errorf("unexpected Notification: %+v", notice)
+	close(l.closing)
+	var err error
+	select {
+	case <-l.done:
+	case <-ctx.Done():
+		err = ctx.Err()
 	}
-	if notice.Extra == "init" {
-		handler.Init(table)
-		l.inited[table] <- struct{}{}
-		close(l.inited[table])
-		return
+	if e := l.listener.Close(); e != nil && err == nil {
+		err = errs.Trace(e)
 	}
+	for _, table := range l.tables() {
+		l.removeHandler(table)
+		if l.options.DropTriggers {
+			if e := dropExistingTrigger(ctx, l.db, table, l.options.Consumer); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
 
-	var msg message
-	if err := json.Unmarshal([]byte(notice.Extra), &msg); err != nil {
-		l.logger.Error(err)
+// notify sends a notification with extra to the loop, after the notifications already arrived.
+func (l *Listener) notify(table, extra string) error {
+	l.notifyMutex.RLock()
+	defer l.notifyMutex.RUnlock()
+	if l.closed {
+		return errClosed
 	}
+	l.listener.Notify <- &pq.Notification{Channel: l.GetChannel(table), Extra: extra}
+	return nil
+}
+
+func (l *Listener) getHandler(table string) Handler {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.handlers[table]
+}
+
+func (l *Listener) removeHandler(table string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.handlers, table)
+	delete(l.inited, table)
+}
+
+// tables returns the listened tables.
+func (l *Listener) tables() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var tables = make([]string, 0, len(l.handlers))
+	for table := range l.handlers {
+		tables = append(tables, table)
+	}
+	return tables
+}
+
+// apply a change to the handler, return false if it's an unexpected message.
+func (l *Listener) apply(table string, handler Handler, msg message) bool {
 	switch msg.Action {
 	case "INSERT":
 		handler.Create(table, msg.New)
@@ -146,17 +335,42 @@ func (l *Listener) handle(notice *pq.Notification) {
 		handler.Update(table, msg.Old, msg.New)
 	case "DELETE":
 		handler.Delete(table, msg.Old)
+	case "TRUNCATE":
+		truncate(table, handler)
+	case "BATCH":
+		return l.applyBatch(table, handler, msg)
+	case "BULK":
+		l.bulkChange(table, handler, msg)
 	default:
 		l.logger.Errorf("unexpected msg: %+v", msg)
+		return false
+	}
+	return true
+}
+
+func truncate(table string, handler Handler) {
+	if truncater, ok := handler.(Truncater); ok {
+		truncater.Truncate(table)
+	} else {
+		handler.ConnLoss(table)
 	}
 }
 
 func (l *Listener) GetChannel(table string) string {
-	return "pgnotify_" + table
+	return l.channelPrefix() + table
 }
 
 func (l *Listener) GetTable(channel string) string {
-	return strings.TrimPrefix(channel, "pgnotify_")
+	return strings.TrimPrefix(channel, l.channelPrefix())
+}
+
+// channelPrefix returns the prefix of the channel names. The consumer is followed by "$", which
+// can't appear in it, so the channels of different consumers and tables never collide.
+func (l *Listener) channelPrefix() string {
+	if l.options.Consumer == "" {
+		return "pgnotify_"
+	}
+	return "pgnotify_" + l.options.Consumer + "$"
 }
 
 func (l *Listener) eventLogger(event pq.ListenerEventType, err error) {
@@ -1,10 +1,10 @@
 package pglistener_test
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"os"
-	"time"
 
 	"github.com/lovego/errs"
 	loggerPkg "github.com/lovego/logger"
@@ -34,6 +34,10 @@ func (h testHandler) Delete(table string, oldBuf []byte) {
 	fmt.Printf("Delete %s\n  %s\n", table, oldBuf)
 }
 
+func (h testHandler) Truncate(table string) {
+	fmt.Printf("Truncate %s\n", table)
+}
+
 func (h testHandler) ConnLoss(table string) {
 	fmt.Printf("ConnLoss %s\n", table)
 }
@@ -51,6 +55,7 @@ func ExampleListener_Listen() {
 	//   new: {"id": 1, "name": "韩梅梅", "time": "2018-09-09"}
 	// Delete public.students2
 	//   {"id": 1, "name": "韩梅梅", "time": "2018-09-09"}
+	// Truncate public.students2
 	// Init public.students2
 	// Create public.students2
 	//   {"id": 1, "name": "李雷", "time": "2018-09-08"}
@@ -59,6 +64,7 @@ func ExampleListener_Listen() {
 	//   new: {"id": 1, "name": "韩梅梅", "time": "2018-09-09"}
 	// Delete public.students2
 	//   {"id": 1, "name": "韩梅梅", "time": "2018-09-09"}
+	// Truncate public.students2
 }
 
 func testCreateUpdateDelete(table string) {
@@ -97,11 +103,20 @@ func testCreateUpdateDelete(table string) {
 	if _, err = testDB.Exec(`DELETE FROM students2`); err != nil {
 		panic(err)
 	}
+	if _, err = testDB.Exec(`TRUNCATE students2`); err != nil {
+		panic(err)
+	}
 
-	time.Sleep(10 * time.Millisecond)
+	// wait until the changes above are handled.
+	if err := listener.Sync(context.Background(), table); err != nil {
+		panic(err)
+	}
 	if err := listener.Unlisten(table); err != nil {
 		panic(err)
 	}
+	if err := listener.Close(context.Background()); err != nil {
+		panic(err)
+	}
 }
 
 func createStudentsTable() {
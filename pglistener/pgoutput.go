@@ -0,0 +1,402 @@
+package pglistener
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// a relation described by the pgoutput plugin.
+type relation struct {
+	id      uint32
+	table   string
+	columns []relationColumn
+}
+
+type relationColumn struct {
+	name    string
+	typeOID uint32
+}
+
+// a column value of a tuple, nil if it's null.
+type tupleColumn struct {
+	kind  byte // 'n': null, 'u': unchanged toasted value, 't': text value
+	value []byte
+}
+
+type changeMessage struct {
+	action     string // INSERT, UPDATE, DELETE or TRUNCATE
+	relationId uint32
+	old        []tupleColumn
+	new        []tupleColumn
+	// only for TRUNCATE
+	relationIds []uint32
+}
+
+type pgoutputReader struct {
+	buf []byte
+	err error
+}
+
+func (r *pgoutputReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.buf) < 1 {
+		r.err = errors.New("pgoutput: unexpected end of message")
+		return 0
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b
+}
+
+func (r *pgoutputReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.buf) < n {
+		r.err = errors.New("pgoutput: unexpected end of message")
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *pgoutputReader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *pgoutputReader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *pgoutputReader) uint64() uint64 {
+	if b := r.bytes(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *pgoutputReader) string() string {
+	if r.err != nil {
+		return ""
+	}
+	i := bytes.IndexByte(r.buf, 0)
+	if i < 0 {
+		r.err = errors.New("pgoutput: unterminated string")
+		return ""
+	}
+	s := string(r.buf[:i])
+	r.buf = r.buf[i+1:]
+	return s
+}
+
+func (r *pgoutputReader) tuple() []tupleColumn {
+	n := int(r.uint16())
+	columns := make([]tupleColumn, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		column := tupleColumn{kind: r.byte()}
+		switch column.kind {
+		case 'n', 'u':
+		case 't':
+			column.value = r.bytes(int(r.uint32()))
+		default:
+			r.err = fmt.Errorf("pgoutput: unknown tuple column kind: %c", column.kind)
+		}
+		columns = append(columns, column)
+	}
+	return columns
+}
+
+// parseRelation parses a pgoutput Relation message, the leading 'R' byte excluded.
+func parseRelation(data []byte) (*relation, error) {
+	r := &pgoutputReader{buf: data}
+	rel := &relation{id: r.uint32()}
+	rel.table = r.string() + "." + r.string()
+	r.byte() // replica identity setting
+	n := int(r.uint16())
+	for i := 0; i < n && r.err == nil; i++ {
+		r.byte() // flags
+		column := relationColumn{name: r.string(), typeOID: r.uint32()}
+		r.uint32() // type modifier
+		rel.columns = append(rel.columns, column)
+	}
+	return rel, r.err
+}
+
+// parseChange parses a pgoutput Insert/Update/Delete/Truncate message, the leading byte included.
+func parseChange(data []byte) (*changeMessage, error) {
+	r := &pgoutputReader{buf: data}
+	msg := &changeMessage{}
+	switch r.byte() {
+	case 'I':
+		msg.action = "INSERT"
+		msg.relationId = r.uint32()
+		r.byte() // 'N'
+		msg.new = r.tuple()
+	case 'U':
+		msg.action = "UPDATE"
+		msg.relationId = r.uint32()
+		switch r.byte() {
+		case 'K', 'O':
+			msg.old = r.tuple()
+			r.byte() // 'N'
+		}
+		msg.new = r.tuple()
+		// unchanged toasted values are only present in the old tuple.
+		for i := range msg.new {
+			if msg.new[i].kind == 'u' && i < len(msg.old) {
+				msg.new[i] = msg.old[i]
+			}
+		}
+	case 'D':
+		msg.action = "DELETE"
+		msg.relationId = r.uint32()
+		r.byte() // 'K' or 'O'
+		msg.old = r.tuple()
+	case 'T':
+		msg.action = "TRUNCATE"
+		n := int(r.uint32())
+		r.byte() // options
+		for i := 0; i < n && r.err == nil; i++ {
+			msg.relationIds = append(msg.relationIds, r.uint32())
+		}
+	default:
+		return nil, fmt.Errorf("pgoutput: unexpected message type: %c", data[0])
+	}
+	return msg, r.err
+}
+
+// tupleJSON converts a tuple to a json object like "to_jsonb" does.
+// If columns is not empty, only these columns are included.
+func tupleJSON(rel *relation, tuple []tupleColumn, columns map[string]bool) ([]byte, error) {
+	var buf = bytes.NewBufferString("{")
+	var first = true
+	for i, column := range rel.columns {
+		if len(columns) > 0 && !columns[column.name] {
+			continue
+		}
+		if i >= len(tuple) {
+			break
+		}
+		if !first {
+			buf.WriteString(", ")
+		}
+		first = false
+		name, err := json.Marshal(column.name)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteString(": ")
+		if err := writeJSONValue(buf, column.typeOID, tuple[i]); err != nil {
+			return nil, err
+		}
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// type oids of pg_type
+const (
+	boolOID        = 16
+	int8OID        = 20
+	int2OID        = 21
+	int4OID        = 23
+	oidOID         = 26
+	jsonOID        = 114
+	float4OID      = 700
+	float8OID      = 701
+	timestampOID   = 1114
+	timestamptzOID = 1184
+	numericOID     = 1700
+	jsonbOID       = 3802
+	textOID        = 25
+	bpcharOID      = 1042
+	varcharOID     = 1043
+)
+
+// the element type oids of the array types converted to json arrays.
+var arrayElemOIDs = map[uint32]uint32{
+	1000: boolOID, 1005: int2OID, 1007: int4OID, 1016: int8OID, 1028: oidOID,
+	1021: float4OID, 1022: float8OID, 1231: numericOID, 199: jsonOID, 3807: jsonbOID,
+	1115: timestampOID, 1185: timestamptzOID, 1009: textOID, 1014: bpcharOID, 1015: varcharOID,
+}
+
+func writeJSONValue(buf *bytes.Buffer, typeOID uint32, column tupleColumn) error {
+	if column.kind != 't' {
+		buf.WriteString("null")
+		return nil
+	}
+	text := string(column.value)
+	switch typeOID {
+	case boolOID:
+		if text == "t" {
+			buf.WriteString("true")
+		} else {
+			buf.WriteString("false")
+		}
+		return nil
+	case int2OID, int4OID, int8OID, oidOID, float4OID, float8OID, numericOID:
+		if text != "NaN" && text != "Infinity" && text != "-Infinity" {
+			buf.WriteString(text)
+			return nil
+		}
+	case jsonOID, jsonbOID:
+		buf.WriteString(text)
+		return nil
+	case timestampOID, timestamptzOID:
+		text = isoTimestamp(text)
+	default:
+		if elemOID, ok := arrayElemOIDs[typeOID]; ok {
+			return writeJSONArray(buf, elemOID, text)
+		}
+	}
+	b, err := json.Marshal(text)
+	if err != nil {
+		return err
+	}
+	buf.Write(b)
+	return nil
+}
+
+// writeJSONArray converts an array like `{1,NULL}` or `{{"a b","c"},{d,e}}` to a json array.
+func writeJSONArray(buf *bytes.Buffer, elemOID uint32, text string) error {
+	// the bounds are present only if the lower bound is not 1, like "[0:1]={1,2}".
+	s := text
+	if strings.HasPrefix(s, "[") {
+		if i := strings.Index(s, "="); i > 0 {
+			s = s[i+1:]
+		}
+	}
+	if rest, ok := writeArrayText(buf, elemOID, s); !ok || rest != "" {
+		return fmt.Errorf("pglistener: invalid array: %s", text)
+	}
+	return nil
+}
+
+// writeArrayText writes the array at the beginning of s, and returns the remaining of s.
+func writeArrayText(buf *bytes.Buffer, elemOID uint32, s string) (string, bool) {
+	if !strings.HasPrefix(s, "{") {
+		return "", false
+	}
+	s = s[1:]
+	buf.WriteByte('[')
+	if strings.HasPrefix(s, "}") {
+		buf.WriteByte(']')
+		return s[1:], true
+	}
+	for first := true; ; first = false {
+		if !first {
+			buf.WriteString(", ")
+		}
+		if strings.HasPrefix(s, "{") {
+			var ok bool
+			if s, ok = writeArrayText(buf, elemOID, s); !ok {
+				return "", false
+			}
+		} else {
+			var elem tupleColumn
+			elem, s = arrayElement(s)
+			if err := writeJSONValue(buf, elemOID, elem); err != nil {
+				return "", false
+			}
+		}
+		switch {
+		case strings.HasPrefix(s, ","):
+			s = s[1:]
+		case strings.HasPrefix(s, "}"):
+			buf.WriteByte(']')
+			return s[1:], true
+		default:
+			return "", false
+		}
+	}
+}
+
+// arrayElement returns the element at the beginning of s, and the remaining of s.
+func arrayElement(s string) (tupleColumn, string) {
+	if !strings.HasPrefix(s, `"`) {
+		i := strings.IndexAny(s, ",}")
+		if i < 0 {
+			i = len(s)
+		}
+		if s[:i] == "NULL" {
+			return tupleColumn{kind: 'n'}, s[i:]
+		}
+		return tupleColumn{kind: 't', value: []byte(s[:i])}, s[i:]
+	}
+	var value []byte
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				value = append(value, s[i])
+			}
+		case '"':
+			return tupleColumn{kind: 't', value: value}, s[i+1:]
+		default:
+			value = append(value, s[i])
+		}
+	}
+	return tupleColumn{kind: 't', value: value}, ""
+}
+
+// isoTimestamp converts "2018-09-08 15:55:00+08" to "2018-09-08T15:55:00+08:00".
+func isoTimestamp(s string) string {
+	s = strings.Replace(s, " ", "T", 1)
+	if i := strings.LastIndexAny(s, "+-"); i > 0 && i > strings.IndexByte(s, 'T') {
+		if zone := s[i+1:]; len(zone) == 2 {
+			s += ":00"
+		}
+	}
+	return s
+}
+
+// equalColumns reports whether the columns of two tuples are equal.
+// If columns is empty, all columns are compared.
+func equalColumns(rel *relation, a, b []tupleColumn, columns map[string]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if len(columns) > 0 && i < len(rel.columns) && !columns[rel.columns[i].name] {
+			continue
+		}
+		if a[i].kind != b[i].kind || !bytes.Equal(a[i].value, b[i].value) {
+			return false
+		}
+	}
+	return true
+}
+
+// columnNames returns the column names of a columns expression like "id, name, $1.time".
+// It returns nil if some column is not a plain column name, so all columns are used.
+func columnNames(columns string) map[string]bool {
+	var result = make(map[string]bool)
+	for _, column := range strings.Split(columns, ",") {
+		column = strings.TrimPrefix(strings.TrimSpace(column), "$1.")
+		if column == "" {
+			continue
+		}
+		for _, c := range column {
+			if !(c == '_' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9') {
+				return nil
+			}
+		}
+		result[column] = true
+	}
+	return result
+}
@@ -0,0 +1,101 @@
+package pglistener
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+func Example_parseRelation() {
+	var data []byte
+	data = appendUint32(data, 16385)
+	data = append(data, "public\x00students2\x00"...)
+	data = append(data, 'f')
+	data = appendUint16(data, 3)
+	for _, c := range []struct {
+		name string
+		oid  uint32
+	}{{"id", int8OID}, {"name", 1043}, {"time", timestamptzOID}} {
+		data = append(data, 0)
+		data = append(data, c.name+"\x00"...)
+		data = appendUint32(data, c.oid)
+		data = appendUint32(data, 0xffffffff)
+	}
+	rel, err := parseRelation(data)
+	fmt.Println(rel.id, rel.table, rel.columns, err)
+	// Output:
+	// 16385 public.students2 [{id 20} {name 1043} {time 1184}] <nil>
+}
+
+func Example_parseChange() {
+	rel := &relation{id: 1, table: "public.students2", columns: []relationColumn{
+		{"id", int8OID}, {"name", 1043}, {"time", timestamptzOID}, {"other", 25},
+	}}
+	oldTuple := testTuple("1", "李雷", "2018-09-08 15:55:00+08", "")
+	newTuple := testTuple("1", "韩梅梅", "2018-09-09 15:56:00+08", "")
+
+	var data = append([]byte{'U'}, appendUint32(nil, 1)...)
+	data = append(append(data, 'O'), oldTuple...)
+	data = append(append(data, 'N'), newTuple...)
+
+	msg, err := parseChange(data)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	oldContent, _ := tupleJSON(rel, msg.old, columnNames("id, name, time"))
+	newContent, _ := tupleJSON(rel, msg.new, nil)
+	fmt.Println(msg.action, msg.relationId)
+	fmt.Printf("%s\n%s\n", oldContent, newContent)
+	fmt.Println(equalColumns(rel, msg.old, msg.new, columnNames("id, other")))
+	fmt.Println(equalColumns(rel, msg.old, msg.new, columnNames("id, name")))
+	fmt.Println(columnNames("$1.id, to_char($1.time, 'YYYY-MM-DD') as time"))
+	// Output:
+	// UPDATE 1
+	// {"id": 1, "name": "李雷", "time": "2018-09-08T15:55:00+08:00"}
+	// {"id": 1, "name": "韩梅梅", "time": "2018-09-09T15:56:00+08:00", "other": ""}
+	// true
+	// false
+	// map[]
+}
+
+func Example_writeJSONArray() {
+	rel := &relation{id: 1, table: "public.students2", columns: []relationColumn{
+		{"ids", 1016}, {"names", 1009}, {"times", 1185}, {"matrix", 1007}, {"empty", 1009},
+	}}
+	tuple := []tupleColumn{
+		{kind: 't', value: []byte(`{1,NULL,3}`)},
+		{kind: 't', value: []byte(`{李雷,"a \"b\\",NULL,"NULL"}`)},
+		{kind: 't', value: []byte(`{"2018-09-08 15:55:00+08"}`)},
+		{kind: 't', value: []byte(`[0:1][1:2]={{1,2},{3,4}}`)},
+		{kind: 't', value: []byte(`{}`)},
+	}
+	content, err := tupleJSON(rel, tuple, nil)
+	fmt.Printf("%s %v\n", content, err)
+	_, err = tupleJSON(rel, []tupleColumn{{kind: 't', value: []byte(`{1,2`)}}, nil)
+	fmt.Println(err)
+	// Output:
+	// {"ids": [1, null, 3], "names": ["李雷", "a \"b\\", null, "NULL"], "times": ["2018-09-08T15:55:00+08:00"], "matrix": [[1, 2], [3, 4]], "empty": []} <nil>
+	// pglistener: invalid array: {1,2
+}
+
+func testTuple(values ...string) []byte {
+	data := appendUint16(nil, uint16(len(values)))
+	for _, v := range values {
+		data = append(data, 't')
+		data = appendUint32(data, uint32(len(v)))
+		data = append(data, v...)
+	}
+	return data
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
@@ -0,0 +1,417 @@
+package pglistener
+
+import (
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lovego/errs"
+)
+
+// PollOptions describes how to poll the changes of a table.
+type PollOptions struct {
+	// The column which increases when a row is inserted or updated, such as "updated_at" or
+	// "version". It's "updated_at" by default.
+	VersionColumn string
+	// The comma seperated primary key columns of the table, "id" by default. The old content passed
+	// to Handler.Update and Handler.Delete consists of only these columns.
+	KeyColumns string
+	// The interval to poll the rows changed, 1 second by default.
+	Interval time.Duration
+	// The interval to compare the keys and versions of all rows, to detect the deleted rows and the
+	// rows missed by polling (for example, committed later than a newer version), 1 minute by default.
+	FullCheckInterval time.Duration
+}
+
+const (
+	defaultPollInterval      = time.Second
+	defaultFullCheckInterval = time.Minute
+)
+
+// PollingListener polls the changes of tables by a version column, for the databases where
+// functions and triggers can't be created, such as read replicas. Only the keys, versions and
+// content hashes of the rows are kept, so the handlers should find the old rows by the key columns.
+type PollingListener struct {
+	db      *sql.DB
+	logger  Logger
+	options PollOptions
+
+	mutex   sync.Mutex
+	pollers map[string]*poller
+	closed  bool
+}
+
+// a poller polls the changes of a table in a goroutine.
+type poller struct {
+	*PollingListener
+	table   string
+	columns string
+	options PollOptions
+	handler Handler
+
+	// the version and content hash of the rows by key, only accessed by the poller goroutine.
+	rows        map[string]polledVersion
+	lastVersion sql.NullString
+	lastCheck   time.Time
+
+	stop, done chan struct{}
+	// the requests of Sync, the channel is closed after polled.
+	syncs chan chan struct{}
+}
+
+type polledRow struct {
+	Key     string // the json object of the key columns.
+	Version string
+	Content string
+}
+
+type polledVersion struct {
+	Version string
+	Hash    [md5.Size]byte // the md5 of the content.
+}
+
+// NewPolling creates a PollingListener, options is the default PollOptions of the tables.
+func NewPolling(
+	dbAddr string, db *sql.DB, logger Logger, options PollOptions,
+) (*PollingListener, error) {
+	if db == nil {
+		var err error
+		if db, err = getDb(dbAddr); err != nil {
+			return nil, err
+		}
+	}
+	return &PollingListener{
+		db: db, logger: logger, options: options, pollers: make(map[string]*poller),
+	}, nil
+}
+
+// Listen a table with the default PollOptions.
+// The "checkColumns" is not used, a row is notified if its version is changed.
+func (l *PollingListener) Listen(table string, columns, checkColumns string, handler Handler) error {
+	return l.ListenWithOptions(table, columns, l.options, handler)
+}
+
+// ListenWithOptions polls a table and notifies the handler with "columns" when a row is created or
+// updated or deleted. Handler.Init is called before it returns.
+func (l *PollingListener) ListenWithOptions(
+	table string, columns string, options PollOptions, handler Handler,
+) error {
+	if strings.IndexByte(table, '.') < 0 {
+		table = "public." + table
+	}
+	if options.VersionColumn == "" {
+		options.VersionColumn = "updated_at"
+	}
+	if options.KeyColumns == "" {
+		options.KeyColumns = "id"
+	}
+	if options.Interval <= 0 {
+		options.Interval = defaultPollInterval
+	}
+	if options.FullCheckInterval <= 0 {
+		options.FullCheckInterval = defaultFullCheckInterval
+	}
+	p := &poller{
+		PollingListener: l, table: table, columns: columns, options: options, handler: handler,
+		rows: make(map[string]polledVersion), stop: make(chan struct{}), done: make(chan struct{}),
+		syncs: make(chan chan struct{}),
+	}
+
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return errClosed
+	}
+	if _, ok := l.pollers[table]; ok {
+		l.mutex.Unlock()
+		return fmt.Errorf("pglistener: table '%s' is aready listened.", table)
+	}
+	l.pollers[table] = p
+	l.mutex.Unlock()
+
+	// the rows are got before Handler.Init, so the changes during Init are polled later.
+	if err := p.loadAll(); err != nil {
+		l.mutex.Lock()
+		delete(l.pollers, table)
+		l.mutex.Unlock()
+		return err
+	}
+	handler.Init(table)
+	go p.loop()
+	return nil
+}
+
+// Unlisten a table, the handler of the table is not notified any more after it returns.
+func (l *PollingListener) Unlisten(table string) error {
+	if strings.IndexByte(table, '.') < 0 {
+		table = "public." + table
+	}
+	l.mutex.Lock()
+	p := l.pollers[table]
+	delete(l.pollers, table)
+	l.mutex.Unlock()
+	if p != nil {
+		close(p.stop)
+		<-p.done
+	}
+	return nil
+}
+
+// Sync polls the table immediately, and waits until the changes polled have been applied to the
+// handler. A change committed before Sync is called is visible to the handler after Sync returns.
+func (l *PollingListener) Sync(ctx context.Context, table string) error {
+	if strings.IndexByte(table, '.') < 0 {
+		table = "public." + table
+	}
+	l.mutex.Lock()
+	p := l.pollers[table]
+	l.mutex.Unlock()
+	if p == nil {
+		return fmt.Errorf("pglistener: table '%s' is not listened.", table)
+	}
+	synced := make(chan struct{})
+	select {
+	case p.syncs <- synced:
+	case <-p.done:
+		return errClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-synced:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// UnlistenAll stops polling all the tables, tables can be listened again after it.
+func (l *PollingListener) UnlistenAll() error {
+	return l.stopAll(context.Background(), false)
+}
+
+// Close stops polling all the tables. If ctx is done before the polling stopped, ctx.Err() is
+// returned. Tables can't be listened any more after it.
+func (l *PollingListener) Close(ctx context.Context) error {
+	return l.stopAll(ctx, true)
+}
+
+func (l *PollingListener) stopAll(ctx context.Context, closeListener bool) error {
+	l.mutex.Lock()
+	pollers := l.pollers
+	l.pollers = make(map[string]*poller)
+	if closeListener {
+		l.closed = true
+	}
+	l.mutex.Unlock()
+
+	for _, p := range pollers {
+		close(p.stop)
+	}
+	for _, p := range pollers {
+		select {
+		case <-p.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (p *poller) loop() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.options.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case synced := <-p.syncs:
+			if err := p.poll(); err != nil {
+				p.logger.Error(err)
+			}
+			close(synced)
+		case <-ticker.C:
+			var err error
+			if time.Since(p.lastCheck) >= p.options.FullCheckInterval {
+				err = p.fullCheck()
+			} else {
+				err = p.poll()
+			}
+			if err != nil {
+				p.logger.Error(err)
+			}
+		}
+	}
+}
+
+// loadAll loads the versions and content hashes of all the rows.
+func (p *poller) loadAll() error {
+	rows, err := p.query("")
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		p.rows[row.Key] = polledVersion{Version: row.Version, Hash: md5.Sum([]byte(row.Content))}
+	}
+	p.updateVersion(rows)
+	p.lastCheck = time.Now()
+	return nil
+}
+
+// poll the rows whose version is not less than the last version. The rows of the last version are
+// polled again, because more rows of the same version may be committed later.
+func (p *poller) poll() error {
+	if !p.lastVersion.Valid {
+		return p.fullCheck()
+	}
+	rows, err := p.query(
+		fmt.Sprintf("WHERE %s >= $1", p.options.VersionColumn), p.lastVersion.String,
+	)
+	if err != nil {
+		return err
+	}
+	if p.apply(rows) {
+		p.flush()
+	}
+	p.updateVersion(rows)
+	return nil
+}
+
+// fullCheck compares the keys and versions of all the rows, to detect the deleted rows and the
+// rows missed by polling.
+func (p *poller) fullCheck() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	sqlRows, err := p.db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT %s, coalesce((%s)::text, '') FROM %s",
+		p.keySql(), p.options.VersionColumn, p.table,
+	))
+	if err != nil {
+		return errs.Trace(err)
+	}
+	defer sqlRows.Close()
+	var versions = make(map[string]string, len(p.rows))
+	var changedKeys []string
+	for sqlRows.Next() {
+		var key, version string
+		if err := sqlRows.Scan(&key, &version); err != nil {
+			return errs.Trace(err)
+		}
+		versions[key] = version
+		if row, ok := p.rows[key]; !ok || row.Version != version {
+			changedKeys = append(changedKeys, key)
+		}
+	}
+	if err := sqlRows.Err(); err != nil {
+		return errs.Trace(err)
+	}
+
+	var changed bool
+	for key := range p.rows {
+		if _, ok := versions[key]; !ok {
+			delete(p.rows, key)
+			p.handler.Delete(p.table, []byte(key))
+			changed = true
+		}
+	}
+	if len(changedKeys) > 0 {
+		rows, err := p.query(
+			fmt.Sprintf("WHERE %s = ANY($1::text[])", p.keySql()),
+			"{"+strings.Join(quoteArrayElements(changedKeys), ",")+"}",
+		)
+		if err != nil {
+			return err
+		}
+		if p.apply(rows) {
+			changed = true
+		}
+	}
+	if changed {
+		p.flush()
+	}
+	p.lastCheck = time.Now()
+	return nil
+}
+
+// apply the rows polled to the handler, return true if any row is changed.
+// The old content of an updated row is its key, since the old content is not kept.
+func (p *poller) apply(rows []polledRow) bool {
+	var changed bool
+	for _, row := range rows {
+		old, ok := p.rows[row.Key]
+		current := polledVersion{Version: row.Version, Hash: md5.Sum([]byte(row.Content))}
+		p.rows[row.Key] = current
+		if ok && old.Hash == current.Hash {
+			continue
+		}
+		if ok {
+			p.handler.Update(p.table, []byte(row.Key), []byte(row.Content))
+		} else {
+			p.handler.Create(p.table, []byte(row.Content))
+		}
+		changed = true
+	}
+	return changed
+}
+
+func (p *poller) flush() {
+	if flusher, ok := p.handler.(Flusher); ok {
+		flusher.Flush(p.table)
+	}
+}
+
+// updateVersion updates the last version by the rows ordered by version.
+func (p *poller) updateVersion(rows []polledRow) {
+	if len(rows) > 0 && rows[len(rows)-1].Version != "" {
+		p.lastVersion = sql.NullString{String: rows[len(rows)-1].Version, Valid: true}
+	}
+}
+
+// query the key, version and content of rows by the where clause, ordered by version.
+func (p *poller) query(where string, args ...interface{}) ([]polledRow, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	sqlRows, err := p.db.QueryContext(ctx, fmt.Sprintf(`
+SELECT %s, coalesce((%s)::text, ''),
+  (SELECT row_to_json(r) FROM (SELECT %s) AS r)::text
+FROM %s %s
+ORDER BY %s NULLS FIRST`, p.keySql(), p.options.VersionColumn, p.columns, p.table, where,
+		p.options.VersionColumn,
+	), args...)
+	if err != nil {
+		return nil, errs.Trace(err)
+	}
+	defer sqlRows.Close()
+	var rows []polledRow
+	for sqlRows.Next() {
+		var row polledRow
+		if err := sqlRows.Scan(&row.Key, &row.Version, &row.Content); err != nil {
+			return nil, errs.Trace(err)
+		}
+		rows = append(rows, row)
+	}
+	if err := sqlRows.Err(); err != nil {
+		return nil, errs.Trace(err)
+	}
+	return rows, nil
+}
+
+// keySql returns the sql expression of the json object of the key columns.
+func (p *poller) keySql() string {
+	return fmt.Sprintf("(SELECT row_to_json(k) FROM (SELECT %s) AS k)::text", p.options.KeyColumns)
+}
+
+// quoteArrayElements quotes the elements of a postgresql array literal.
+func quoteArrayElements(elements []string) []string {
+	var quoted = make([]string, len(elements))
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	for i, element := range elements {
+		quoted[i] = `"` + replacer.Replace(element) + `"`
+	}
+	return quoted
+}
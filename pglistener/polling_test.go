@@ -0,0 +1,44 @@
+package pglistener
+
+import "fmt"
+
+type pollTestHandler struct {
+	bulkTestHandler
+}
+
+func (h pollTestHandler) Update(table string, oldContent, newContent []byte) {
+	fmt.Println("Update", table, string(oldContent), string(newContent))
+}
+
+func Example_pollerApply() {
+	p := &poller{
+		table: "t", options: PollOptions{KeyColumns: "id"}, handler: pollTestHandler{},
+		rows: make(map[string]polledVersion),
+	}
+	rows := []polledRow{
+		{Key: `{"id":1}`, Version: "1", Content: `{"id":1,"name":"a"}`},
+		{Key: `{"id":2}`, Version: "2", Content: `{"id":2,"name":"b"}`},
+	}
+	fmt.Println(p.apply(rows))
+	p.updateVersion(rows)
+
+	// the rows of the last version are polled again, but not changed,
+	// and the old content of an updated row is its key.
+	fmt.Println(p.apply([]polledRow{
+		{Key: `{"id":2}`, Version: "2", Content: `{"id":2,"name":"b"}`},
+		{Key: `{"id":1}`, Version: "3", Content: `{"id":1,"name":"c"}`},
+	}))
+	fmt.Println(p.lastVersion.String, p.rows[`{"id":1}`].Version)
+	fmt.Println(p.keySql())
+
+	fmt.Println(quoteArrayElements([]string{`[1]`, `["a\"b"]`}))
+	// Output:
+	// Create t {"id":1,"name":"a"}
+	// Create t {"id":2,"name":"b"}
+	// true
+	// Update t {"id":1} {"id":1,"name":"c"}
+	// true
+	// 2 3
+	// (SELECT row_to_json(k) FROM (SELECT id) AS k)::text
+	// ["[1]" "[\"a\\\"b\"]"]
+}
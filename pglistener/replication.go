@@ -0,0 +1,617 @@
+package pglistener
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/lovego/errs"
+)
+
+// ReplicationListener gets INSERT/UPDATE/DELETE/TRUNCATE events of postgresql's tables from a
+// logical replication slot using the pgoutput plugin, instead of triggers and LISTEN/NOTIFY.
+// The events are passed to the same handlers as Listener's.
+//
+// The replication stream resumes from the slot after reconnects, so ConnLoss is called only if
+// the slot has been lost. The slot is kept after Close, and the server retains the WAL not consumed
+// by it, which may fill up the disk, so use DropSlot if the slot is not used any more.
+// The changes of the transactions committed before a table is listened are skipped, since they're
+// loaded by Handler.Init. The changes of a transaction are passed to TxHandler.ApplyTx together
+// if the handler implements it. The listened tables must be "REPLICA IDENTITY FULL" to get the old
+// row on UPDATE and DELETE, Listen returns an error otherwise. The columns to listen must be plain
+// column names, otherwise all columns are passed to the handlers.
+type ReplicationListener struct {
+	dbAddr string
+	db     *sql.DB // db to create the slot and publication
+	slot   string  // name of the slot, also used as the publication name
+	logger Logger
+
+	// ctx is canceled to stop the loop, and done is closed after the loop stopped.
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mutex     sync.Mutex // protect the fields below
+	handlers  map[string]*replicationHandler
+	relations map[uint32]*relation
+	// the changed tables in current transaction
+	changed map[string]bool
+	// the changes of current transaction for TxHandlers
+	txChanges map[string][]Change
+	// the lsn of the commit of current transaction
+	txLSN uint64
+	// the end lsn of the last committed transaction handled
+	lsn uint64
+	// the handler calls of the message handling, they're made after the mutex is unlocked.
+	calls []func()
+}
+
+type replicationHandler struct {
+	Handler
+	columns      map[string]bool
+	checkColumns map[string]bool
+	// the transactions committed before it are loaded by Init, so they're skipped.
+	initLSN uint64
+	// the calls are buffered while Init is running, and made after it in order.
+	initing bool
+	pending []func()
+}
+
+var slotNameRegexp = regexp.MustCompile(`^[a-z0-9_]{1,63}$`)
+
+// NewReplication creates a ReplicationListener using the slot. The slot and a publication of the
+// same name are created if not exist. The database must be configured with "wal_level = logical".
+func NewReplication(dbAddr string, db *sql.DB, slot string, logger Logger) (*ReplicationListener, error) {
+	if !slotNameRegexp.MatchString(slot) {
+		return nil, fmt.Errorf("pglistener: invalid replication slot name: '%s'", slot)
+	}
+	if db == nil {
+		var err error
+		if db, err = getDb(dbAddr); err != nil {
+			return nil, err
+		}
+	}
+	l := &ReplicationListener{
+		dbAddr:    dbAddr,
+		db:        db,
+		slot:      slot,
+		logger:    logger,
+		handlers:  make(map[string]*replicationHandler),
+		relations: make(map[uint32]*relation),
+		changed:   make(map[string]bool),
+		txChanges: make(map[string][]Change),
+		done:      make(chan struct{}),
+	}
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	if err := l.createPublication(); err != nil {
+		return nil, err
+	}
+	if _, err := l.createSlot(); err != nil {
+		return nil, err
+	}
+	go l.loop()
+	return l, nil
+}
+
+// Listen a table and notify the handler with "columns" when a row is created or updated or deleted.
+// When a row is updated, the handler is notified only if some "columns" or "checkColumns" has changed.
+func (l *ReplicationListener) Listen(table string, columns, checkColumns string, handler Handler) error {
+	if strings.IndexByte(table, '.') < 0 {
+		table = "public." + table
+	}
+	h, err := l.addHandler(table, columns, checkColumns, handler)
+	if err != nil {
+		return err
+	}
+	// Init is called outside the mutex, the changes during it are buffered and applied after it.
+	handler.Init(table)
+	l.initDone(h)
+	return nil
+}
+
+func (l *ReplicationListener) addHandler(
+	table string, columns, checkColumns string, handler Handler,
+) (*replicationHandler, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, ok := l.handlers[table]; ok {
+		return nil, fmt.Errorf("pglistener: table '%s' is aready listened.", table)
+	}
+	if full, err := l.replicaIdentityFull(table); err != nil {
+		return nil, err
+	} else if !full {
+		return nil, fmt.Errorf(
+			"pglistener: table '%s' should be REPLICA IDENTITY FULL to get the old rows, "+
+				"run 'ALTER TABLE %s REPLICA IDENTITY FULL' first.", table, table,
+		)
+	}
+	if ok, err := l.inPublication(table); err != nil {
+		return nil, err
+	} else if !ok {
+		if err := l.exec(fmt.Sprintf(`ALTER PUBLICATION %s ADD TABLE %s`, l.slot, table)); err != nil {
+			return nil, err
+		}
+	}
+	lsn, err := l.currentLSN()
+	if err != nil {
+		return nil, err
+	}
+	h := &replicationHandler{
+		Handler: handler, columns: columnNames(columns), initLSN: lsn, initing: true,
+	}
+	if h.columns != nil {
+		h.checkColumns = columnNames(columns + "," + checkColumns)
+	}
+	l.handlers[table] = h
+	return h, nil
+}
+
+// initDone makes the calls buffered during Init in order, until there are no more of them.
+func (l *ReplicationListener) initDone(h *replicationHandler) {
+	for {
+		l.mutex.Lock()
+		calls := h.pending
+		h.pending = nil
+		if len(calls) == 0 {
+			h.initing = false
+		}
+		l.mutex.Unlock()
+		if len(calls) == 0 {
+			return
+		}
+		for _, call := range calls {
+			call()
+		}
+	}
+}
+
+func (l *ReplicationListener) Unlisten(table string) error {
+	if strings.IndexByte(table, '.') < 0 {
+		table = "public." + table
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.handlers, table)
+	if ok, err := l.inPublication(table); err != nil {
+		return err
+	} else if ok {
+		return l.exec(fmt.Sprintf(`ALTER PUBLICATION %s DROP TABLE %s`, l.slot, table))
+	}
+	return nil
+}
+
+func (l *ReplicationListener) UnlistenAll() error {
+	l.mutex.Lock()
+	var tables []string
+	for table := range l.handlers {
+		tables = append(tables, table)
+	}
+	l.mutex.Unlock()
+	for _, table := range tables {
+		if err := l.Unlisten(table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops the loop and closes the replication connection, the handlers are not notified any
+// more after it returns. The slot is kept, so the changes can be resumed from it by a new listener.
+// If ctx is done before the handling message finished, ctx.Err() is returned.
+func (l *ReplicationListener) Close(ctx context.Context) error {
+	l.cancel()
+	var err error
+	select {
+	case <-l.done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	l.mutex.Lock()
+	l.handlers = make(map[string]*replicationHandler)
+	l.mutex.Unlock()
+	return err
+}
+
+// DropSlot drops the slot and the publication, it should be called after Close. The changes not
+// consumed are lost, so the tables are loaded by Init if they're listened by the slot again.
+func (l *ReplicationListener) DropSlot(ctx context.Context) error {
+	if l.ctx.Err() == nil {
+		return errors.New("pglistener: DropSlot should be called after Close.")
+	}
+	if _, err := l.db.ExecContext(ctx, `SELECT pg_drop_replication_slot(slot_name)
+FROM pg_replication_slots WHERE slot_name = $1`, l.slot); err != nil {
+		return errs.Trace(err)
+	}
+	if _, err := l.db.ExecContext(ctx, `DROP PUBLICATION IF EXISTS `+l.slot); err != nil {
+		return errs.Trace(err)
+	}
+	return nil
+}
+
+func (l *ReplicationListener) loop() {
+	defer close(l.done)
+	for {
+		if err := l.stream(); err != nil && l.ctx.Err() == nil {
+			l.logger.Error(err)
+		}
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// stream connects to the db, and handles the replication stream until an error occurs.
+func (l *ReplicationListener) stream() error {
+	conn, err := pgconn.Connect(l.ctx, replicationAddr(l.dbAddr))
+	if err != nil {
+		return errs.Trace(err)
+	}
+	defer conn.Close(context.Background())
+
+	if created, err := l.createSlot(); err != nil {
+		return err
+	} else if created { // the slot has been lost, so all the changes after the lsn are lost.
+		l.connLoss()
+	}
+	if err := l.startReplication(conn); err != nil {
+		return err
+	}
+
+	statusTime := time.Now()
+	for {
+		if time.Since(statusTime) >= 10*time.Second {
+			if err := l.sendStatus(conn); err != nil {
+				return err
+			}
+			statusTime = time.Now()
+		}
+		ctx, cancel := context.WithDeadline(l.ctx, statusTime.Add(10*time.Second))
+		msg, err := conn.ReceiveMessage(ctx)
+		cancel()
+		if err != nil {
+			if pgconn.Timeout(err) {
+				continue
+			}
+			return errs.Trace(err)
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.CopyData:
+			if replyRequested, err := l.handleCopyData(msg.Data); err != nil {
+				return err
+			} else if replyRequested {
+				if err := l.sendStatus(conn); err != nil {
+					return err
+				}
+				statusTime = time.Now()
+			}
+		case *pgproto3.ErrorResponse:
+			return errs.Trace(pgconn.ErrorResponseToPgError(msg))
+		default:
+			l.logger.Errorf("pglistener: unexpected replication message: %T", msg)
+		}
+	}
+}
+
+func (l *ReplicationListener) startReplication(conn *pgconn.PgConn) error {
+	sql := fmt.Sprintf(
+		`START_REPLICATION SLOT %s LOGICAL 0/0 (proto_version '1', publication_names '%s')`,
+		l.slot, l.slot,
+	)
+	if err := conn.SendBytes(context.Background(), (&pgproto3.Query{String: sql}).Encode(nil)); err != nil {
+		return errs.Trace(err)
+	}
+	msg, err := conn.ReceiveMessage(context.Background())
+	if err != nil {
+		return errs.Trace(err)
+	}
+	switch msg := msg.(type) {
+	case *pgproto3.CopyBothResponse:
+		return nil
+	case *pgproto3.ErrorResponse:
+		return errs.Trace(pgconn.ErrorResponseToPgError(msg))
+	default:
+		return fmt.Errorf("pglistener: unexpected START_REPLICATION response: %T", msg)
+	}
+}
+
+// handleCopyData handles a XLogData or a primary keepalive message.
+func (l *ReplicationListener) handleCopyData(data []byte) (bool, error) {
+	r := &pgoutputReader{buf: data}
+	switch r.byte() {
+	case 'k': // primary keepalive message
+		r.uint64() // the current end of WAL on the server
+		r.uint64() // the server's system clock
+		return r.byte() == 1, r.err
+	case 'w': // XLogData
+		r.bytes(24) // WAL start, WAL end and the server's system clock
+		if r.err != nil {
+			return false, r.err
+		}
+		return false, l.handleMessage(r.buf)
+	}
+	return false, nil
+}
+
+func (l *ReplicationListener) handleMessage(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	l.mutex.Lock()
+	err := l.parseMessage(data)
+	calls := l.calls
+	l.calls = nil
+	l.mutex.Unlock()
+
+	// the handlers are called outside the mutex, so they can call the methods of the listener.
+	for _, call := range calls {
+		call()
+	}
+	return err
+}
+
+// parseMessage parses a message and collects the handler calls, the caller should hold the mutex.
+func (l *ReplicationListener) parseMessage(data []byte) error {
+	switch data[0] {
+	case 'B':
+		r := &pgoutputReader{buf: data[1:]}
+		l.txLSN = r.uint64() // the LSN of the commit
+		if r.err != nil {
+			return r.err
+		}
+	case 'R':
+		rel, err := parseRelation(data[1:])
+		if err != nil {
+			return err
+		}
+		l.relations[rel.id] = rel
+	case 'C':
+		r := &pgoutputReader{buf: data[1:]}
+		r.byte()   // flags
+		r.uint64() // the LSN of the commit
+		endLSN := r.uint64()
+		if r.err != nil {
+			return r.err
+		}
+		for table := range l.changed {
+			if h := l.handlers[table]; h != nil {
+				if txHandler, ok := h.Handler.(TxHandler); ok && len(l.txChanges[table]) > 0 {
+					table, changes := table, l.txChanges[table]
+					l.call(h, func() { txHandler.ApplyTx(table, changes) })
+				}
+				if flusher, ok := h.Handler.(Flusher); ok {
+					table := table
+					l.call(h, func() { flusher.Flush(table) })
+				}
+			}
+			delete(l.changed, table)
+			delete(l.txChanges, table)
+		}
+		l.lsn = endLSN
+	case 'I', 'U', 'D', 'T':
+		msg, err := parseChange(data)
+		if err != nil {
+			return err
+		}
+		l.handleChange(msg)
+	}
+	return nil
+}
+
+func (l *ReplicationListener) handleChange(msg *changeMessage) {
+	if msg.action == "TRUNCATE" {
+		for _, id := range msg.relationIds {
+			if rel := l.relations[id]; rel != nil {
+				if h := l.handlers[rel.table]; h != nil && l.txLSN >= h.initLSN {
+					l.apply(rel.table, h, Change{Action: msg.action})
+				}
+			}
+		}
+		return
+	}
+	rel := l.relations[msg.relationId]
+	if rel == nil {
+		l.logger.Errorf("pglistener: unknown relation id: %d", msg.relationId)
+		return
+	}
+	h := l.handlers[rel.table]
+	if h == nil || l.txLSN < h.initLSN {
+		return
+	}
+
+	var change = Change{Action: msg.action}
+	var err error
+	if msg.old != nil {
+		if change.Old, err = tupleJSON(rel, msg.old, h.columns); err != nil {
+			l.logger.Error(err)
+			return
+		}
+	}
+	if msg.new != nil {
+		if change.New, err = tupleJSON(rel, msg.new, h.columns); err != nil {
+			l.logger.Error(err)
+			return
+		}
+	}
+	if msg.action == "UPDATE" {
+		if change.Old == nil {
+			l.logger.Errorf("pglistener: no old row of '%s', is it REPLICA IDENTITY FULL?", rel.table)
+			change.Action = "INSERT"
+		} else if equalColumns(rel, msg.old, msg.new, h.checkColumns) {
+			return
+		}
+	}
+	l.apply(rel.table, h, change)
+}
+
+// apply a change to the handler. If the handler is a TxHandler, the change is buffered until the
+// transaction commits.
+func (l *ReplicationListener) apply(table string, h *replicationHandler, change Change) {
+	l.changed[table] = true
+	if _, ok := h.Handler.(TxHandler); ok {
+		l.txChanges[table] = append(l.txChanges[table], change)
+		return
+	}
+	switch change.Action {
+	case "INSERT":
+		l.call(h, func() { h.Create(table, change.New) })
+	case "UPDATE":
+		l.call(h, func() { h.Update(table, change.Old, change.New) })
+	case "DELETE":
+		l.call(h, func() { h.Delete(table, change.Old) })
+	case "TRUNCATE":
+		l.call(h, func() { truncate(table, h.Handler) })
+	}
+}
+
+// call collects a handler call, or buffers it if the handler's Init is running.
+// The caller should hold the mutex.
+func (l *ReplicationListener) call(h *replicationHandler, fn func()) {
+	if h.initing {
+		h.pending = append(h.pending, fn)
+	} else {
+		l.calls = append(l.calls, fn)
+	}
+}
+
+func (l *ReplicationListener) connLoss() {
+	l.mutex.Lock()
+	for table, h := range l.handlers {
+		table, h := table, h
+		l.call(h, func() { h.ConnLoss(table) })
+	}
+	calls := l.calls
+	l.calls = nil
+	l.mutex.Unlock()
+	for _, call := range calls {
+		call()
+	}
+}
+
+// sendStatus sends a standby status update, so the server can release the WAL handled.
+func (l *ReplicationListener) sendStatus(conn *pgconn.PgConn) error {
+	l.mutex.Lock()
+	lsn := l.lsn
+	l.mutex.Unlock()
+
+	var buf = make([]byte, 34)
+	buf[0] = 'r'
+	binary.BigEndian.PutUint64(buf[1:], lsn)  // written
+	binary.BigEndian.PutUint64(buf[9:], lsn)  // flushed
+	binary.BigEndian.PutUint64(buf[17:], lsn) // applied
+	binary.BigEndian.PutUint64(buf[25:], uint64(time.Since(pgEpoch)/time.Microsecond))
+	buf[33] = 0
+
+	if err := conn.SendBytes(context.Background(), (&pgproto3.CopyData{Data: buf}).Encode(nil)); err != nil {
+		return errs.Trace(err)
+	}
+	return nil
+}
+
+var pgEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func (l *ReplicationListener) createPublication() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var count int
+	if err := l.db.QueryRowContext(ctx,
+		`SELECT count(*) FROM pg_publication WHERE pubname = $1`, l.slot,
+	).Scan(&count); err != nil {
+		return errs.Trace(err)
+	}
+	if count > 0 {
+		return nil
+	}
+	return l.exec(`CREATE PUBLICATION ` + l.slot)
+}
+
+// createSlot creates the slot if not exists, and reports whether it's created.
+func (l *ReplicationListener) createSlot() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var count int
+	if err := l.db.QueryRowContext(ctx,
+		`SELECT count(*) FROM pg_replication_slots WHERE slot_name = $1`, l.slot,
+	).Scan(&count); err != nil {
+		return false, errs.Trace(err)
+	}
+	if count > 0 {
+		return false, nil
+	}
+	if _, err := l.db.ExecContext(ctx,
+		`SELECT pg_create_logical_replication_slot($1, 'pgoutput')`, l.slot,
+	); err != nil {
+		return false, errs.Trace(err)
+	}
+	return true, nil
+}
+
+// currentLSN returns the current WAL write location.
+func (l *ReplicationListener) currentLSN() (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var lsn int64
+	if err := l.db.QueryRowContext(ctx,
+		`SELECT (pg_current_wal_lsn() - '0/0')::bigint`,
+	).Scan(&lsn); err != nil {
+		return 0, errs.Trace(err)
+	}
+	return uint64(lsn), nil
+}
+
+func (l *ReplicationListener) inPublication(table string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var count int
+	if err := l.db.QueryRowContext(ctx, `SELECT count(*) FROM pg_publication_tables
+WHERE pubname = $1 AND schemaname || '.' || tablename = $2`, l.slot, table,
+	).Scan(&count); err != nil {
+		return false, errs.Trace(err)
+	}
+	return count > 0, nil
+}
+
+// replicaIdentityFull reports whether the old rows are fully logged for the table.
+func (l *ReplicationListener) replicaIdentityFull(table string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var identity string
+	if err := l.db.QueryRowContext(ctx,
+		`SELECT relreplident FROM pg_class WHERE oid = $1::regclass`, table,
+	).Scan(&identity); err != nil {
+		return false, errs.Trace(err)
+	}
+	return identity == "f", nil
+}
+
+func (l *ReplicationListener) exec(sql string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if _, err := l.db.ExecContext(ctx, sql); err != nil {
+		return errs.Trace(err)
+	}
+	return nil
+}
+
+func (l *ReplicationListener) DB() *sql.DB {
+	return l.db
+}
+
+func replicationAddr(dbAddr string) string {
+	if strings.Contains(dbAddr, "://") {
+		if strings.IndexByte(dbAddr, '?') >= 0 {
+			return dbAddr + "&replication=database"
+		}
+		return dbAddr + "?replication=database"
+	}
+	return dbAddr + " replication=database"
+}
@@ -0,0 +1,69 @@
+package pglistener
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	loggerPkg "github.com/lovego/logger"
+)
+
+type replicationTestHandler struct {
+	Handler
+	l *ReplicationListener
+}
+
+func (h replicationTestHandler) Create(table string, content []byte) {
+	// the handler is called outside the mutex, so it can call the methods of the listener.
+	h.l.mutex.Lock()
+	h.l.mutex.Unlock()
+	fmt.Println("Create", table, string(content))
+}
+
+func ExampleReplicationListener_handleMessage() {
+	l := &ReplicationListener{
+		logger:   loggerPkg.New(os.Stderr),
+		handlers: make(map[string]*replicationHandler),
+		relations: map[uint32]*relation{
+			1: {id: 1, table: "public.t", columns: []relationColumn{{"id", int8OID}}},
+		},
+		changed:   make(map[string]bool),
+		txChanges: make(map[string][]Change),
+	}
+	h := &replicationHandler{Handler: replicationTestHandler{l: l}, initLSN: 100}
+	l.handlers["public.t"] = h
+
+	var insert = func(lsn uint64, id string) {
+		for _, data := range [][]byte{
+			appendUint32(appendUint64(appendUint64([]byte{'B'}, lsn), 0), 1),
+			append(append(appendUint32([]byte{'I'}, 1), 'N'), testTuple(id)...),
+			appendUint64(appendUint64(appendUint64([]byte{'C', 0}, lsn), lsn+1), 0),
+		} {
+			if err := l.handleMessage(data); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+	// committed before the handler's Init, so it's skipped.
+	insert(90, "1")
+
+	// buffered during the handler's Init, and applied after it.
+	h.initing = true
+	insert(110, "2")
+	fmt.Println(len(h.pending))
+	l.initDone(h)
+
+	insert(120, "3")
+	fmt.Println(l.lsn)
+	// Output:
+	// 1
+	// Create public.t {"id": 2}
+	// Create public.t {"id": 3}
+	// 121
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
@@ -0,0 +1,69 @@
+package pglistener
+
+import (
+	"encoding/json"
+)
+
+// BulkHandler is optionally implemented by a Handler. In StatementLevel mode, if the rows changed
+// by a statement are too many to be notified, BulkChange is called with the statement (INSERT,
+// UPDATE or DELETE) and the number of rows changed. If not implemented, ConnLoss is called instead.
+type BulkHandler interface {
+	BulkChange(table string, op string, rows int64)
+}
+
+const defaultBulkThreshold = 1000
+
+// applyBatch applies the rows changed by a statement, return false if it's an unexpected message.
+// The old and new rows of an UPDATE statement can't be paired, so the old rows are deleted first,
+// then the new rows are inserted. If the handler is a TxHandler, they are applied together.
+func (l *Listener) applyBatch(table string, handler Handler, msg message) bool {
+	changes, err := batchChanges(msg)
+	if err != nil {
+		l.logger.Errorf("unexpected msg: %+v, %v", msg, err)
+		return false
+	}
+	if txHandler, ok := handler.(TxHandler); ok {
+		txHandler.ApplyTx(table, changes)
+		return true
+	}
+	for _, change := range changes {
+		if change.Action == "INSERT" {
+			handler.Create(table, change.New)
+		} else {
+			handler.Delete(table, change.Old)
+		}
+	}
+	return true
+}
+
+// batchChanges converts a BATCH message to DELETE changes of the old rows followed by INSERT
+// changes of the new rows.
+func batchChanges(msg message) ([]Change, error) {
+	var olds, news []json.RawMessage
+	if len(msg.Old) > 0 {
+		if err := json.Unmarshal(msg.Old, &olds); err != nil {
+			return nil, err
+		}
+	}
+	if len(msg.New) > 0 {
+		if err := json.Unmarshal(msg.New, &news); err != nil {
+			return nil, err
+		}
+	}
+	var changes = make([]Change, 0, len(olds)+len(news))
+	for _, old := range olds {
+		changes = append(changes, Change{Action: "DELETE", Old: old})
+	}
+	for _, new := range news {
+		changes = append(changes, Change{Action: "INSERT", New: new})
+	}
+	return changes, nil
+}
+
+func (l *Listener) bulkChange(table string, handler Handler, msg message) {
+	if bulkHandler, ok := handler.(BulkHandler); ok {
+		bulkHandler.BulkChange(table, msg.Op, msg.Rows)
+	} else {
+		handler.ConnLoss(table)
+	}
+}
@@ -0,0 +1,53 @@
+package pglistener
+
+import (
+	"fmt"
+	"os"
+
+	loggerPkg "github.com/lovego/logger"
+)
+
+type bulkTestHandler struct {
+	Handler
+}
+
+func (h bulkTestHandler) Create(table string, content []byte) {
+	fmt.Println("Create", table, string(content))
+}
+
+func (h bulkTestHandler) Delete(table string, content []byte) {
+	fmt.Println("Delete", table, string(content))
+}
+
+func (h bulkTestHandler) BulkChange(table string, op string, rows int64) {
+	fmt.Println("BulkChange", table, op, rows)
+}
+
+func ExampleListener_applyBatch() {
+	l := &Listener{logger: loggerPkg.New(os.Stderr)}
+	w := l.newWorker()
+	h := bulkTestHandler{}
+	fmt.Println(w.dispatch("t", h, []byte(`{"action":"BATCH","op":"INSERT","new":[{"id":1},{"id":2}]}`)))
+	fmt.Println(w.dispatch("t", h,
+		[]byte(`{"action":"BATCH","op":"UPDATE","old":[{"id":1}],"new":[{"id":3}]}`),
+	))
+	fmt.Println(w.dispatch("t", h, []byte(`{"action":"BULK","op":"DELETE","rows":2000}`)))
+
+	// a TxHandler applies a batch together.
+	fmt.Println(w.dispatch("t", txTestHandler{},
+		[]byte(`{"action":"BATCH","op":"DELETE","old":[{"id":2},{"id":3}]}`),
+	))
+	// Output:
+	// Create t {"id":1}
+	// Create t {"id":2}
+	// true
+	// Delete t {"id":1}
+	// Create t {"id":3}
+	// true
+	// BulkChange t DELETE 2000
+	// true
+	// ApplyTx t
+	//   DELETE {"id":2}
+	//   DELETE {"id":3}
+	// true
+}
@@ -0,0 +1,101 @@
+package pglistener
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/lovego/errs"
+)
+
+// the prefix of the marker notifications sent by Sync.
+const syncPrefix = "sync:"
+
+// syncs waiting for their markers to be handled.
+type syncs struct {
+	mutex   sync.Mutex
+	waiting map[string]*syncWaiter
+	// the id of this process, so the markers of other processes are ignored.
+	id  string
+	seq int64
+}
+
+type syncWaiter struct {
+	table string
+	done  chan struct{}
+}
+
+// Sync sends a marker notification on the channel of the table, and waits until the changes
+// notified before it have been applied to the handler (including Flush). A change committed before
+// Sync is called is notified before the marker, so it's visible to the handler after Sync returns.
+func (l *Listener) Sync(ctx context.Context, table string) error {
+	if strings.IndexByte(table, '.') < 0 {
+		table = "public." + table
+	}
+	if l.getHandler(table) == nil {
+		return fmt.Errorf("pglistener: table '%s' is not listened.", table)
+	}
+	marker, waiter := l.syncs.add(table)
+	defer l.syncs.remove(marker)
+	if _, err := l.db.ExecContext(
+		ctx, "SELECT pg_notify($1, $2)", l.GetChannel(table), marker,
+	); err != nil {
+		return errs.Trace(err)
+	}
+	select {
+	case <-waiter.done:
+		return nil
+	case <-l.done:
+		return errClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *syncs) add(table string) (string, *syncWaiter) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.id == "" {
+		var b [8]byte
+		rand.Read(b[:])
+		s.id = hex.EncodeToString(b[:])
+		s.waiting = make(map[string]*syncWaiter)
+	}
+	s.seq++
+	marker := fmt.Sprintf("%s%s:%d", syncPrefix, s.id, s.seq)
+	waiter := &syncWaiter{table: table, done: make(chan struct{})}
+	s.waiting[marker] = waiter
+	return marker, waiter
+}
+
+func (s *syncs) remove(marker string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.waiting, marker)
+}
+
+// done marks the sync of the marker done, the markers of other processes are ignored.
+func (s *syncs) done(marker string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if waiter := s.waiting[marker]; waiter != nil {
+		close(waiter.done)
+		delete(s.waiting, marker)
+	}
+}
+
+// markers returns the markers of the syncs of the tables.
+func (s *syncs) markers(tables map[string]bool) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var markers []string
+	for marker, waiter := range s.waiting {
+		if tables[waiter.table] {
+			markers = append(markers, marker)
+		}
+	}
+	return markers
+}
@@ -0,0 +1,47 @@
+package pglistener
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/lib/pq"
+	loggerPkg "github.com/lovego/logger"
+)
+
+func ExampleListener_syncMarker() {
+	l := &Listener{
+		logger:   loggerPkg.New(os.Stderr),
+		handlers: make(map[string]Handler),
+		inited:   make(map[string]chan struct{}),
+		workers:  make(map[string]*worker),
+	}
+	events := make(chan string, 10)
+	l.handlers["public.a"] = workerTestHandler{events: events}
+	notify := func(table, extra string) {
+		l.route(&pq.Notification{Channel: l.GetChannel(table), Extra: extra})
+	}
+	notify("public.a", "init")
+	fmt.Println(<-events)
+
+	marker, waiter := l.syncs.add("public.a")
+	_, other := l.syncs.add("public.a")
+	notify("public.a", `{"action":"INSERT","new":{"id":1}}`)
+	notify("public.a", marker)
+	<-waiter.done
+	// the changes before the marker have been handled.
+	fmt.Println(<-events)
+
+	// the syncs waiting are done after a connection loss, because their markers may be missed.
+	l.route(nil)
+	<-other.done
+	fmt.Println(<-events)
+
+	for _, w := range l.allWorkers() {
+		close(w.queue)
+	}
+	l.workersWait.Wait()
+	// Output:
+	// Init public.a
+	// Create public.a {"id":1}
+	// ConnLoss public.a
+}
@@ -1,9 +1,11 @@
 package pglistener
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,37 +17,142 @@ func createPGFunction(db *sql.DB) error {
 	defer cancel()
 	// tg_argv[0] 是需要通知的字段列表
 	// tg_argv[1] 是需要检查是否有变动的字段列表，仅在更新时使用
+	// tg_argv[2] 为 'log' 时，变动同时写入 pgcache_changes 表，通知中带上其 id
+	// tg_argv[3] 是消费者名称，非空时通知到该消费者专属的 channel
+	// tg_argv[4] 为 'tx' 时，通知中带上事务 id 及其在事务中的序号，事务结束时由 pgnotify_commit 通知
+	// tg_argv[5] 是语句级触发器的行数阈值，仅在 StatementLevel 模式使用
+	// TRUNCATE 是语句级触发器，只通知动作本身
+	// INSERT/UPDATE/DELETE 的语句级触发器通过 old_rows/new_rows 转换表读取变动的行：
+	// 行数不超过阈值时，在一个 BATCH 通知中带上所有变动的行，否则只通知 BULK 及行数
 	_, err := db.ExecContext(ctx, `
     create or replace function pgnotify() returns trigger as $$
     declare
+      channel_name text := 'pgnotify_' || tg_table_schema || '.' || tg_table_name;
       old_record record;
       new_record record;
       data jsonb;
+      change_id bigint;
+      seq_name text;
+      seq int;
+      row_count bigint;
+      rows_sql text := 'select to_jsonb(a) v, to_jsonb(b) c from %s t, ' ||
+        'lateral (select %s) a, lateral (select %s%s) b';
+      old_rows_json jsonb;
+      new_rows_json jsonb;
     begin
-      if tg_op = 'UPDATE' then
-        execute 'select ' || tg_argv[0] || tg_argv[1] into old_record using old;
-        execute 'select ' || tg_argv[0] || tg_argv[1] into new_record using new;
-        if old_record = new_record then
+      if tg_nargs > 3 and tg_argv[3] <> '' then
+        channel_name := 'pgnotify_' || tg_argv[3] || '$' || tg_table_schema || '.' || tg_table_name;
+      end if;
+      data := json_build_object('action', tg_op);
+
+      if tg_level = 'STATEMENT' and tg_op <> 'TRUNCATE' then
+        if tg_op = 'INSERT' then
+          execute 'select count(*) from new_rows' into row_count;
+        else
+          execute 'select count(*) from old_rows' into row_count;
+        end if;
+        if row_count = 0 then
           return null;
         end if;
+        data := null;
+        if row_count <= tg_argv[5]::bigint then
+          -- 更新时只通知检查字段有变动的行
+          if tg_op <> 'INSERT' then
+            execute format('select jsonb_agg(o.v) from (' || rows_sql || ') o',
+              'old_rows', tg_argv[0], tg_argv[0], tg_argv[1]) ||
+            case when tg_op = 'UPDATE' then format(' where o.c not in (select n.c from (' ||
+              rows_sql || ') n)', 'new_rows', tg_argv[0], tg_argv[0], tg_argv[1]) else '' end
+            into old_rows_json;
+          end if;
+          if tg_op <> 'DELETE' then
+            execute format('select jsonb_agg(n.v) from (' || rows_sql || ') n',
+              'new_rows', tg_argv[0], tg_argv[0], tg_argv[1]) ||
+            case when tg_op = 'UPDATE' then format(' where n.c not in (select o.c from (' ||
+              rows_sql || ') o)', 'old_rows', tg_argv[0], tg_argv[0], tg_argv[1]) else '' end
+            into new_rows_json;
+          end if;
+          if old_rows_json is null and new_rows_json is null then
+            return null;
+          end if;
+          data := jsonb_build_object('action', 'BATCH', 'op', tg_op);
+          if old_rows_json is not null then
+            data := jsonb_set(data, array['old'], old_rows_json);
+          end if;
+          if new_rows_json is not null then
+            data := jsonb_set(data, array['new'], new_rows_json);
+          end if;
+          -- pg_notify 的 payload 须小于 8000 字节
+          if length(data::text) > 7800 then
+            data := null;
+          end if;
+        end if;
+        if data is null then
+          data := jsonb_build_object('action', 'BULK', 'op', tg_op, 'rows', row_count);
+        end if;
+      elsif tg_op <> 'TRUNCATE' then
+        if tg_op = 'UPDATE' then
+          execute 'select ' || tg_argv[0] || tg_argv[1] into old_record using old;
+          execute 'select ' || tg_argv[0] || tg_argv[1] into new_record using new;
+          if old_record = new_record then
+            return null;
+          end if;
+        end if;
+
+        case tg_op
+        when 'INSERT' then
+          execute 'select ' || tg_argv[0] into new_record using new;
+          data := jsonb_set(data, array['new'], to_jsonb(new_record));
+        when 'UPDATE' then
+          execute 'select ' || tg_argv[0] into old_record using old;
+          execute 'select ' || tg_argv[0] into new_record using new;
+          data := jsonb_set(data, array['old'], to_jsonb(old_record));
+          data := jsonb_set(data, array['new'], to_jsonb(new_record));
+        when 'DELETE' then
+          execute 'select ' || tg_argv[0] into old_record using old;
+          data := jsonb_set(data, array['old'], to_jsonb(old_record));
+        end case;
       end if;
 
-      data := json_build_object('action', tg_op);
-      case tg_op
-      when 'INSERT' then
-        execute 'select ' || tg_argv[0] into new_record using new;
-        data := jsonb_set(data, array['new'], to_jsonb(new_record));
-      when 'UPDATE' then
-        execute 'select ' || tg_argv[0] into old_record using old;
-        execute 'select ' || tg_argv[0] into new_record using new;
-        data := jsonb_set(data, array['old'], to_jsonb(old_record));
-        data := jsonb_set(data, array['new'], to_jsonb(new_record));
-      when 'DELETE' then
-        execute 'select ' || tg_argv[0] into old_record using old;
-        data := jsonb_set(data, array['old'], to_jsonb(old_record));
-      end case;
-
-      perform pg_notify('pgnotify_' || tg_table_schema || '.' || tg_table_name, data::text);
+      if tg_nargs > 4 and tg_argv[4] = 'tx' then
+        seq_name := 'pgnotify.seq_' || tg_relid || '_' || tg_argv[3];
+        seq := coalesce(nullif(current_setting(seq_name, true), ''), '0')::int + 1;
+        perform set_config(seq_name, seq::text, true);
+        data := data || jsonb_build_object('txid', txid_current(), 'seq', seq);
+      end if;
+
+      if tg_nargs > 2 and tg_argv[2] = 'log' then
+        insert into pgcache_changes (channel, payload) values (channel_name, data)
+        returning id into change_id;
+        data := jsonb_set(data, array['id'], to_jsonb(change_id));
+      end if;
+
+      perform pg_notify(channel_name, data::text);
+      return null;
+    end;
+    $$ language plpgsql;
+
+    -- 作为延迟的约束触发器在事务提交时执行，每个事务只通知一次结束标记
+    -- tg_argv[0] 是消费者名称
+    create or replace function pgnotify_commit() returns trigger as $$
+    declare
+      channel_name text := 'pgnotify_' || tg_table_schema || '.' || tg_table_name;
+      seq_name text;
+      done_name text;
+      seq text;
+    begin
+      if tg_argv[0] <> '' then
+        channel_name := 'pgnotify_' || tg_argv[0] || '$' || tg_table_schema || '.' || tg_table_name;
+      end if;
+      seq_name := 'pgnotify.seq_' || tg_relid || '_' || tg_argv[0];
+      done_name := 'pgnotify.done_' || tg_relid || '_' || tg_argv[0];
+      seq := coalesce(current_setting(seq_name, true), '');
+      if seq = '' or coalesce(current_setting(done_name, true), '') = seq then
+        return null;
+      end if;
+      perform set_config(done_name, seq, true);
+      perform pg_notify(channel_name, json_build_object(
+        'action', 'COMMIT', 'txid', txid_current(), 'seq', seq::int
+      )::text);
       return null;
     end;
     $$ language plpgsql;`)
@@ -55,51 +162,252 @@ func createPGFunction(db *sql.DB) error {
 	return nil
 }
 
-func createTrigger(db *sql.DB, table string, columns, checkColumns string) error {
-	if ok, err := hasExistingTrigger(db, table); err != nil {
+// createTrigger creates the triggers of the table. If a trigger exists but its arguments differ
+// from the required ones, it's recreated.
+func createTrigger(
+	db *sql.DB, logger Logger, table string, columns, checkColumns string, options Options,
+) error {
+	columns = dollarPrefix(columns)
+	if checkColumns != "" {
+		checkColumns = "," + dollarPrefix(checkColumns)
+	}
+	// optional arguments: change log flag, consumer name, transactional flag.
+	extraArgs := []string{"", options.Consumer, ""}
+	if options.ChangeLog {
+		extraArgs[0] = "log"
+	}
+	if options.Transactional {
+		extraArgs[2] = "tx"
+	}
+	var rowArgs = extraArgs
+	for len(rowArgs) > 0 && rowArgs[len(rowArgs)-1] == "" {
+		rowArgs = rowArgs[:len(rowArgs)-1]
+	}
+
+	if options.StatementLevel {
+		if err := createStatementTriggers(
+			db, logger, table, columns, checkColumns, extraArgs, options,
+		); err != nil {
+			return err
+		}
+	} else {
+		name := triggerName(options.Consumer)
+		if err := ensureTrigger(db, logger, table, name, `CREATE TRIGGER `+name+
+			` AFTER INSERT OR UPDATE OR DELETE ON %s FOR EACH ROW EXECUTE PROCEDURE pgnotify(%s)`,
+			append([]string{columns, checkColumns}, rowArgs...),
+		); err != nil {
+			return err
+		}
+		for _, op := range statementOps {
+			if err := dropTrigger(db, table, statementTriggerName(options.Consumer, op)); err != nil {
+				return err
+			}
+		}
+	}
+	name := truncateTriggerName(options.Consumer)
+	if err := ensureTrigger(db, logger, table, name, `CREATE TRIGGER `+name+
+		` AFTER TRUNCATE ON %s FOR EACH STATEMENT EXECUTE PROCEDURE pgnotify(%s)`,
+		append([]string{"", ""}, rowArgs...),
+	); err != nil {
 		return err
-	} else if ok {
+	}
+	if options.Transactional {
+		name = commitTriggerName(options.Consumer)
+		return ensureTrigger(db, logger, table, name, `CREATE CONSTRAINT TRIGGER `+name+
+			` AFTER INSERT OR UPDATE OR DELETE ON %s DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE PROCEDURE pgnotify_commit(%s)`,
+			[]string{options.Consumer},
+		)
+	}
+	return nil
+}
+
+var statementOps = []string{"insert", "update", "delete"}
+
+// the transition tables of the statement level triggers.
+var statementReferencing = map[string]string{
+	"insert": "REFERENCING NEW TABLE AS new_rows",
+	"update": "REFERENCING OLD TABLE AS old_rows NEW TABLE AS new_rows",
+	"delete": "REFERENCING OLD TABLE AS old_rows",
+}
+
+// createStatementTriggers creates a statement level trigger with the transition tables for each of
+// INSERT/UPDATE/DELETE, and drops the row level trigger.
+func createStatementTriggers(
+	db *sql.DB, logger Logger, table string, columns, checkColumns string, extraArgs []string, options Options,
+) error {
+	threshold := options.BulkThreshold
+	if threshold <= 0 {
+		threshold = defaultBulkThreshold
+	}
+	args := append([]string{statementColumns(columns), statementColumns(checkColumns)}, extraArgs...)
+	args = append(args, strconv.Itoa(threshold))
+	for _, op := range statementOps {
+		name := statementTriggerName(options.Consumer, op)
+		if err := ensureTrigger(db, logger, table, name, `CREATE TRIGGER `+name+` AFTER `+
+			strings.ToUpper(op)+` ON %s `+statementReferencing[op]+
+			` FOR EACH STATEMENT EXECUTE PROCEDURE pgnotify(%s)`, args,
+		); err != nil {
+			return err
+		}
+	}
+	return dropTrigger(db, table, triggerName(options.Consumer))
+}
+
+// statementColumns converts the columns for a row level trigger to that for a statement level
+// trigger, in which a transition table row is referenced as "t".
+func statementColumns(columns string) string {
+	return strings.Replace(columns, "$1.", "t.", -1)
+}
+
+func triggerName(consumer string) string {
+	if consumer == "" {
+		return "pgnotify"
+	}
+	return "pgnotify_" + consumer + "_row"
+}
+
+func truncateTriggerName(consumer string) string {
+	if consumer == "" {
+		return "pgnotify_truncate"
+	}
+	return "pgnotify_" + consumer + "_truncate"
+}
+
+func statementTriggerName(consumer, op string) string {
+	if consumer == "" {
+		return "pgnotify_" + op
+	}
+	return "pgnotify_" + consumer + "_" + op
+}
+
+func commitTriggerName(consumer string) string {
+	if consumer == "" {
+		return "pgnotify_commit"
+	}
+	return "pgnotify_" + consumer + "_commit"
+}
+
+// ensureTrigger creates the trigger using createSql, which is formatted with the table and the
+// quoted args. If the trigger exists with different args, it's recreated in a transaction.
+func ensureTrigger(db *sql.DB, logger Logger, table, name, createSql string, args []string) error {
+	existingArgs, exists, err := getTriggerArgs(db, table, name)
+	if err != nil {
+		return err
+	}
+	if exists && equalStrings(existingArgs, args) {
 		return nil
 	}
 
-	columns = dollarPrefix(columns)
-	if checkColumns != "" {
-		checkColumns = "," + dollarPrefix(checkColumns)
+	var quotedArgs = make([]string, len(args))
+	for i := range args {
+		quotedArgs[i] = quote(args[i])
 	}
+	createSql = fmt.Sprintf(createSql, table, strings.Join(quotedArgs, ", "))
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	if _, err := db.ExecContext(ctx, fmt.Sprintf(
-		`CREATE TRIGGER pgnotify AFTER INSERT OR UPDATE OR DELETE ON %s
-    FOR EACH ROW EXECUTE PROCEDURE pgnotify(%s, %s)`,
-		table, quote(columns), quote(checkColumns)),
-	); err != nil {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errs.Trace(err)
+	}
+	defer tx.Rollback()
+	if exists {
+		if _, err := tx.ExecContext(
+			ctx, fmt.Sprintf("DROP TRIGGER IF EXISTS %s ON %s", name, table),
+		); err != nil {
+			return errs.Trace(err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, createSql); err != nil {
 		return errs.Trace(err)
 	}
+	if err := tx.Commit(); err != nil {
+		return errs.Trace(err)
+	}
+	if exists {
+		infof(logger, "pglistener: trigger %s on %s is recreated, arguments changed from %q to %q",
+			name, table, existingArgs, args)
+	}
 	return nil
 }
 
-func hasExistingTrigger(db *sql.DB, table string) (bool, error) {
+// getTriggerArgs returns the arguments of the trigger, and whether the trigger exists.
+func getTriggerArgs(db *sql.DB, table, name string) ([]string, bool, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	row := db.QueryRowContext(ctx, fmt.Sprintf(`SELECT count(*) AS count FROM pg_trigger
-WHERE NOT tgisinternal AND tgname = 'pgnotify' AND tgrelid='%s'::regclass
-`, table))
-	var count int
-	if err := row.Scan(&count); err != nil {
-		return false, errs.Trace(err)
+	row := db.QueryRowContext(ctx, fmt.Sprintf(`SELECT tgargs FROM pg_trigger
+WHERE NOT tgisinternal AND tgname = %s AND tgrelid='%s'::regclass
+`, quote(name), table))
+	var tgargs []byte
+	if err := row.Scan(&tgargs); err == sql.ErrNoRows {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, errs.Trace(err)
 	}
+	return parseTriggerArgs(tgargs), true, nil
+}
 
-	return count > 0, nil
+// parseTriggerArgs parses pg_trigger.tgargs, every argument of which is terminated by a '\0'.
+func parseTriggerArgs(tgargs []byte) []string {
+	var args = []string{}
+	for len(tgargs) > 0 {
+		i := bytes.IndexByte(tgargs, 0)
+		if i < 0 {
+			args = append(args, string(tgargs))
+			break
+		}
+		args = append(args, string(tgargs[:i]))
+		tgargs = tgargs[i+1:]
+	}
+	return args
 }
 
-func dropExistingTrigger(db *sql.DB, table string) error {
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// dropTrigger drops the trigger if it exists. The existence is checked first, so the table is not
+// locked if the trigger doesn't exist.
+func dropTrigger(db *sql.DB, table, name string) error {
+	if _, exists, err := getTriggerArgs(db, table, name); err != nil || !exists {
+		return err
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
+	if _, err := db.ExecContext(
+		ctx, fmt.Sprintf("DROP TRIGGER IF EXISTS %s ON %s", name, table),
+	); err != nil {
+		return errs.Trace(err)
+	}
+	return nil
+}
 
-	_, err := db.ExecContext(ctx, fmt.Sprintf("DROP TRIGGER IF EXISTS pgnotify ON %s", table))
-	if err != nil {
+// dropExistingTrigger drops all the triggers of the consumer on the table.
+func dropExistingTrigger(ctx context.Context, db *sql.DB, table, consumer string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var names = []string{
+		triggerName(consumer), truncateTriggerName(consumer), commitTriggerName(consumer),
+	}
+	for _, op := range statementOps {
+		names = append(names, statementTriggerName(consumer, op))
+	}
+	var sqls []string
+	for _, name := range names {
+		sqls = append(sqls, fmt.Sprintf("DROP TRIGGER IF EXISTS %s ON %s", name, table))
+	}
+	if _, err := db.ExecContext(ctx, strings.Join(sqls, "; ")); err != nil {
 		return errs.Trace(err)
 	}
 	return nil
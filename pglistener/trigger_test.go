@@ -0,0 +1,37 @@
+package pglistener
+
+import "fmt"
+
+func Example_parseTriggerArgs() {
+	fmt.Printf("%q\n", parseTriggerArgs(nil))
+	fmt.Printf("%q\n", parseTriggerArgs([]byte("$1.id,$1.name\x00\x00")))
+	fmt.Printf("%q\n", parseTriggerArgs([]byte("$1.id\x00,$1.name\x00log\x00")))
+	// Output:
+	// []
+	// ["$1.id,$1.name" ""]
+	// ["$1.id" ",$1.name" "log"]
+}
+
+func Example_triggerName() {
+	fmt.Println(triggerName(""), truncateTriggerName(""))
+	fmt.Println(triggerName("app1"), truncateTriggerName("app1"))
+
+	l := &Listener{options: Options{Consumer: "app1"}}
+	fmt.Println(l.GetChannel("public.students"), l.GetTable("pgnotify_app1$public.students"))
+	fmt.Println(l.Listen("students_with_a_very_long_name_exceeding_the_limit", "id", "", nil))
+	// Output:
+	// pgnotify pgnotify_truncate
+	// pgnotify_app1_row pgnotify_app1_truncate
+	// pgnotify_app1$public.students public.students
+	// pglistener: channel name 'pgnotify_app1$public.students_with_a_very_long_name_exceeding_the_limit' is longer than 63 bytes.
+}
+
+func Example_statementColumns() {
+	fmt.Println(statementColumns(dollarPrefix("id, name")))
+	fmt.Println(statementColumns(",to_char($1.time, 'YYYY') as year"))
+	fmt.Println(statementTriggerName("", "update"), statementTriggerName("app1", "update"))
+	// Output:
+	// t.id,t.name
+	// ,to_char(t.time, 'YYYY') as year
+	// pgnotify_update pgnotify_app1_update
+}
@@ -0,0 +1,146 @@
+package pglistener
+
+import (
+	"sort"
+	"time"
+)
+
+// TxHandler is optionally implemented by a Handler. In Transactional mode, the changes of a
+// transaction are passed to ApplyTx together, instead of calling Create/Update/Delete/Truncate.
+type TxHandler interface {
+	ApplyTx(table string, changes []Change)
+}
+
+// Change is a change of a table row.
+type Change struct {
+	Action string // INSERT, UPDATE, DELETE or TRUNCATE
+	Old    []byte // the old content, present for UPDATE and DELETE.
+	New    []byte // the new content, present for INSERT and UPDATE.
+}
+
+// A transaction consisting only of TRUNCATE has no end marker, and the end marker may be missed
+// by a connection loss. Since all notifications of a transaction are sent at commit time, a
+// transaction buffered longer than Options.TxEndTimeout without any new notification is regarded
+// as ended.
+const defaultTxEndTimeout = 100 * time.Millisecond
+
+// the buffered changes of a transaction.
+type tx struct {
+	id       int64
+	handler  Handler
+	messages []message
+	// the time when it's regarded as ended, renewed by every notification of it.
+	deadline time.Time
+}
+
+// bufferTx buffers a change of a transaction, and applies the transaction if it's ended.
+// It reports whether any change is applied.
+func (w *worker) bufferTx(table string, handler Handler, msg message) bool {
+	if msg.Txid == 0 { // notified by a trigger created not in Transactional mode.
+		w.endTx(table, handler)
+		return w.apply(table, handler, msg)
+	}
+	current := w.txs[table]
+	if msg.Action == "COMMIT" {
+		if current != nil && current.id == msg.Txid {
+			return w.endTx(table, handler)
+		}
+		return false
+	}
+
+	var applied bool
+	// notifications of a transaction are delivered together, so a new transaction ends the current.
+	if current != nil && current.id != msg.Txid {
+		applied = w.endTx(table, handler)
+		current = nil
+	}
+	if current == nil {
+		current = &tx{id: msg.Txid, handler: handler}
+		w.txs[table] = current
+	}
+	current.messages = append(current.messages, msg)
+	current.deadline = time.Now().Add(w.txEndTimeout())
+	return applied
+}
+
+// endTx applies the buffered transaction of the table, and reports whether it exists.
+func (w *worker) endTx(table string, handler Handler) bool {
+	current := w.txs[table]
+	if current == nil {
+		return false
+	}
+	delete(w.txs, table)
+	sort.SliceStable(current.messages, func(i, j int) bool {
+		return current.messages[i].Seq < current.messages[j].Seq
+	})
+	w.applyTx(table, handler, current.messages)
+	return true
+}
+
+// endTxs applies the buffered transactions whose deadline has passed, and adds their tables to
+// "changed". It's called after every burst and by the timer of the earliest deadline, so a busy
+// table never delays the timeout of the others.
+func (w *worker) endTxs(now time.Time, changed map[string]bool) {
+	for table, current := range w.txs {
+		if now.Before(current.deadline) {
+			continue
+		}
+		infof(w.logger, "pglistener: transaction %d of %s is ended by timeout with %d changes.",
+			current.id, table, len(current.messages))
+		if w.endTx(table, current.handler) {
+			changed[table] = true
+		}
+	}
+}
+
+// txDeadline returns the earliest deadline of the buffered transactions.
+func (w *worker) txDeadline() (time.Time, bool) {
+	var deadline time.Time
+	for _, current := range w.txs {
+		if deadline.IsZero() || current.deadline.Before(deadline) {
+			deadline = current.deadline
+		}
+	}
+	return deadline, !deadline.IsZero()
+}
+
+func (l *Listener) txEndTimeout() time.Duration {
+	if l.options.TxEndTimeout > 0 {
+		return l.options.TxEndTimeout
+	}
+	return defaultTxEndTimeout
+}
+
+func (l *Listener) applyTx(table string, handler Handler, messages []message) {
+	if txHandler, ok := handler.(TxHandler); ok {
+		var changes = make([]Change, 0, len(messages))
+		for _, msg := range messages {
+			switch msg.Action {
+			case "INSERT", "UPDATE", "DELETE", "TRUNCATE":
+				changes = append(changes, Change{Action: msg.Action, Old: msg.Old, New: msg.New})
+			case "BATCH":
+				if batch, err := batchChanges(msg); err != nil {
+					l.logger.Errorf("unexpected msg: %+v, %v", msg, err)
+				} else {
+					changes = append(changes, batch...)
+				}
+			case "BULK":
+				// apply the preceding changes, the following ones are applied after the bulk change.
+				if len(changes) > 0 {
+					txHandler.ApplyTx(table, changes)
+					changes = nil
+				}
+				l.bulkChange(table, handler, msg)
+			default:
+				l.logger.Errorf("unexpected msg: %+v", msg)
+			}
+		}
+		if len(changes) > 0 {
+			txHandler.ApplyTx(table, changes)
+		}
+		return
+	}
+	for _, msg := range messages {
+		l.apply(table, handler, msg)
+	}
+}
@@ -0,0 +1,57 @@
+package pglistener
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	loggerPkg "github.com/lovego/logger"
+)
+
+type txTestHandler struct {
+	Handler
+}
+
+func (h txTestHandler) ApplyTx(table string, changes []Change) {
+	fmt.Println("ApplyTx", table)
+	for _, change := range changes {
+		fmt.Println(" ", strings.TrimSpace(fmt.Sprintf("%s %s %s", change.Action, change.Old, change.New)))
+	}
+}
+
+func Example_bufferTx() {
+	l := &Listener{logger: loggerPkg.New(os.Stderr), options: Options{Transactional: true}}
+	w := l.newWorker()
+	h := txTestHandler{}
+	fmt.Println(w.dispatch("t", h, []byte(`{"action":"INSERT","txid":1,"seq":1,"new":{"id":1}}`)))
+	fmt.Println(w.dispatch("t", h, []byte(`{"action":"UPDATE","txid":1,"seq":2,"old":{"id":1},"new":{"id":2}}`)))
+	fmt.Println(w.dispatch("t", h, []byte(`{"action":"COMMIT","txid":1,"seq":2}`)))
+
+	// a transaction without end marker is ended by the next transaction.
+	fmt.Println(w.dispatch("t", h, []byte(`{"action":"TRUNCATE","txid":2,"seq":1}`)))
+	fmt.Println(w.dispatch("t", h, []byte(`{"action":"DELETE","txid":3,"seq":1,"old":{"id":2}}`)))
+	// or by timeout without any new notification of it.
+	fmt.Println(w.txEndTimeout())
+	var changed = make(map[string]bool)
+	w.endTxs(time.Now(), changed)
+	fmt.Println(changed)
+	w.endTxs(time.Now().Add(w.txEndTimeout()), changed)
+	fmt.Println(changed)
+	// Output:
+	// false
+	// false
+	// ApplyTx t
+	//   INSERT  {"id":1}
+	//   UPDATE {"id":1} {"id":2}
+	// true
+	// false
+	// ApplyTx t
+	//   TRUNCATE
+	// true
+	// 100ms
+	// map[]
+	// ApplyTx t
+	//   DELETE {"id":2}
+	// map[t:true]
+}
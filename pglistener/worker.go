@@ -0,0 +1,311 @@
+package pglistener
+
+import (
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// WorkerPolicy decides how the notifications are dispatched to the handlers.
+type WorkerPolicy int
+
+const (
+	// All tables are handled by a single goroutine in the order of notifications.
+	SingleWorker WorkerPolicy = iota
+	// Every table is handled by its own goroutine, so a slow handler of one table doesn't hold up
+	// the others. The notifications of a table are still handled in order.
+	TableWorkers
+)
+
+const defaultQueueSize = 1000
+
+// A worker handles the notifications of its tables in a goroutine.
+type worker struct {
+	*Listener
+	queue chan *pq.Notification
+	// set to 1 if some notifications are missed, by connection loss or a full queue.
+	missed int32
+
+	// the fields below are only accessed by the worker goroutine.
+	// the tables handled by the worker.
+	handled map[string]bool
+	// the change log state of tables, only used in ChangeLog mode.
+	changeLogs map[string]*changeLog
+	// the buffered transaction of tables, only used in Transactional mode.
+	txs map[string]*tx
+	// the markers of Sync handled in the current burst.
+	synced []string
+}
+
+func (l *Listener) newWorker() *worker {
+	queueSize := l.options.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	return &worker{
+		Listener:   l,
+		queue:      make(chan *pq.Notification, queueSize),
+		handled:    make(map[string]bool),
+		changeLogs: make(map[string]*changeLog),
+		txs:        make(map[string]*tx),
+	}
+}
+
+func (l *Listener) loop() {
+	defer func() {
+		for _, w := range l.allWorkers() {
+			close(w.queue)
+		}
+		l.workersWait.Wait()
+		close(l.done)
+	}()
+	for {
+		select {
+		case <-l.closing:
+			return
+		case notice, ok := <-l.listener.Notify:
+			if !ok {
+				return
+			}
+			l.route(notice)
+		case <-time.After(time.Minute):
+			go l.listener.Ping()
+		}
+	}
+}
+
+// route a notification to the worker of its table.
+func (l *Listener) route(notice *pq.Notification) {
+	if notice == nil { // connection loss
+		for _, w := range l.allWorkers() {
+			w.miss()
+		}
+		return
+	}
+	var table = l.GetTable(notice.Channel)
+	w := l.workers[table]
+	switch notice.Extra {
+	case "init":
+		if w == nil {
+			w = l.startWorker()
+			l.workers[table] = w
+		}
+		w.queue <- notice
+	case "unlisten":
+		if w != nil {
+			delete(l.workers, table)
+			w.queue <- notice
+			if w != l.sharedWorker {
+				close(w.queue)
+			}
+		}
+	default:
+		if w == nil {
+			l.logger.Errorf("unexpected Notification: %+v", notice)
+			return
+		}
+		if l.options.Workers != TableWorkers {
+			w.queue <- notice
+			return
+		}
+		select {
+		case w.queue <- notice:
+		default:
+			w.miss()
+		}
+	}
+}
+
+func (l *Listener) startWorker() *worker {
+	if l.options.Workers != TableWorkers && l.sharedWorker != nil {
+		return l.sharedWorker
+	}
+	w := l.newWorker()
+	if l.options.Workers != TableWorkers {
+		l.sharedWorker = w
+	}
+	l.workersWait.Add(1)
+	go w.run()
+	return w
+}
+
+// allWorkers returns the distinct workers.
+func (l *Listener) allWorkers() []*worker {
+	if l.options.Workers != TableWorkers {
+		if l.sharedWorker != nil {
+			return []*worker{l.sharedWorker}
+		}
+		return nil
+	}
+	var workers = make([]*worker, 0, len(l.workers))
+	for _, w := range l.workers {
+		workers = append(workers, w)
+	}
+	return workers
+}
+
+// miss marks that some notifications of the worker are missed. The worker handles it as a
+// connection loss after the notifications queued.
+func (w *worker) miss() {
+	atomic.StoreInt32(&w.missed, 1)
+	// if the queue is full, the flag is checked after the queued notifications are handled.
+	select {
+	case w.queue <- &pq.Notification{Extra: "missed"}:
+	default:
+	}
+}
+
+func (w *worker) run() {
+	defer w.workersWait.Done()
+	for {
+		var txTimeout <-chan time.Time
+		if deadline, ok := w.txDeadline(); ok {
+			txTimeout = time.After(time.Until(deadline))
+		}
+		select {
+		case notice, ok := <-w.queue:
+			if !ok {
+				return
+			}
+			w.handleBurst(notice)
+		case now := <-txTimeout:
+			var changed = make(map[string]bool)
+			w.endTxs(now, changed)
+			w.flush(changed)
+		}
+	}
+}
+
+// handle a notification and the following ones which have already arrived,
+// then flush the tables which have been changed.
+func (w *worker) handleBurst(notice *pq.Notification) {
+	var changed = make(map[string]bool)
+	if table := w.handle(notice); table != "" {
+		changed[table] = true
+	}
+burst:
+	for i := 1; i < maxBurstSize; i++ {
+		select {
+		case notice, ok := <-w.queue:
+			if !ok {
+				break burst
+			}
+			if table := w.handle(notice); table != "" {
+				changed[table] = true
+			}
+		default:
+			break burst
+		}
+	}
+	if len(w.txs) > 0 {
+		w.endTxs(time.Now(), changed)
+	}
+	w.flush(changed)
+	if atomic.SwapInt32(&w.missed, 0) == 1 {
+		w.connLoss()
+	}
+	for _, marker := range w.synced {
+		w.syncs.done(marker)
+	}
+	w.synced = w.synced[:0]
+}
+
+// flush the tables which have been changed.
+func (w *worker) flush(changed map[string]bool) {
+	for table := range changed {
+		handler := w.getHandler(table)
+		if handler == nil {
+			continue
+		}
+		if flusher, ok := handler.(Flusher); ok {
+			flusher.Flush(table)
+		}
+		if w.options.ChangeLog {
+			w.reportPosition(table, handler)
+		}
+	}
+}
+
+// handle a notification, return the table name if it's a change of the table.
+func (w *worker) handle(notice *pq.Notification) string {
+	if notice.Extra == "missed" {
+		return ""
+	}
+	if strings.HasPrefix(notice.Extra, syncPrefix) {
+		w.synced = append(w.synced, notice.Extra)
+		return ""
+	}
+	var table = w.GetTable(notice.Channel)
+	if notice.Extra == "unlisten" {
+		delete(w.handled, table)
+		delete(w.changeLogs, table)
+		delete(w.txs, table)
+		return ""
+	}
+	handler := w.getHandler(table)
+	if handler == nil {
+		w.logger.Errorf("unexpected Notification: %+v", notice)
+		return ""
+	}
+	if notice.Extra == "init" {
+		w.handled[table] = true
+		w.initTable(table, handler)
+		w.mutex.Lock()
+		if inited := w.inited[table]; inited != nil {
+			close(inited)
+			delete(w.inited, table)
+		}
+		w.mutex.Unlock()
+		return ""
+	}
+	if w.dispatch(table, handler, []byte(notice.Extra)) {
+		return table
+	}
+	return ""
+}
+
+// connLoss replays the missed changes in ChangeLog mode, or calls Handler.ConnLoss.
+// The markers of Sync may have been missed, so the syncs waiting are done after it.
+func (w *worker) connLoss() {
+	markers := w.syncs.markers(w.handled)
+	defer func() {
+		for _, marker := range markers {
+			w.syncs.done(marker)
+		}
+	}()
+	// the buffered transactions can't be completed any more.
+	w.txs = make(map[string]*tx)
+	for table := range w.handled {
+		handler := w.getHandler(table)
+		if handler == nil {
+			continue
+		}
+		if w.options.ChangeLog {
+			w.replay(table, handler)
+		} else {
+			handler.ConnLoss(table)
+		}
+	}
+}
+
+// dispatch a notification payload to the handler, return false if it's not dispatched.
+func (w *worker) dispatch(table string, handler Handler, payload []byte) bool {
+	var msg message
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		w.logger.Error(err)
+	}
+	return w.dispatchMessage(table, handler, msg)
+}
+
+func (w *worker) dispatchMessage(table string, handler Handler, msg message) bool {
+	if w.options.ChangeLog && !w.changeLogs[table].apply(msg.Id) {
+		return false
+	}
+	if w.options.Transactional {
+		return w.bufferTx(table, handler, msg)
+	}
+	return w.apply(table, handler, msg)
+}
@@ -0,0 +1,77 @@
+package pglistener
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/lib/pq"
+	loggerPkg "github.com/lovego/logger"
+)
+
+type workerTestHandler struct {
+	Handler
+	events chan string
+	block  chan struct{}
+}
+
+func (h workerTestHandler) Init(table string) {
+	h.events <- "Init " + table
+}
+
+func (h workerTestHandler) Create(table string, content []byte) {
+	h.events <- "Create " + table + " " + string(content)
+	if h.block != nil {
+		<-h.block
+	}
+}
+
+func (h workerTestHandler) ConnLoss(table string) {
+	h.events <- "ConnLoss " + table
+}
+
+func ExampleListener_route() {
+	l := &Listener{
+		logger:   loggerPkg.New(os.Stderr),
+		options:  Options{Workers: TableWorkers, QueueSize: 1},
+		handlers: make(map[string]Handler),
+		inited:   make(map[string]chan struct{}),
+		workers:  make(map[string]*worker),
+	}
+	events := make(chan string)
+	block := make(chan struct{})
+	l.handlers["public.a"] = workerTestHandler{events: events, block: block}
+	l.handlers["public.b"] = workerTestHandler{events: events}
+	notify := func(table, extra string) {
+		l.route(&pq.Notification{Channel: l.GetChannel(table), Extra: extra})
+	}
+
+	notify("public.a", "init")
+	fmt.Println(<-events)
+	notify("public.b", "init")
+	fmt.Println(<-events)
+
+	notify("public.a", `{"action":"INSERT","new":{"id":1}}`)
+	fmt.Println(<-events)
+	// the worker of table a is blocked, so the second one is queued, and the third one is dropped.
+	notify("public.a", `{"action":"INSERT","new":{"id":2}}`)
+	notify("public.a", `{"action":"INSERT","new":{"id":3}}`)
+	// table b is not blocked by table a.
+	notify("public.b", `{"action":"INSERT","new":{"id":1}}`)
+	fmt.Println(<-events)
+
+	close(block)
+	fmt.Println(<-events)
+	fmt.Println(<-events)
+
+	for _, w := range l.allWorkers() {
+		close(w.queue)
+	}
+	l.workersWait.Wait()
+	// Output:
+	// Init public.a
+	// Init public.b
+	// Create public.a {"id":1}
+	// Create public.b {"id":1}
+	// Create public.a {"id":2}
+	// ConnLoss public.a
+}
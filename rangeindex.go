@@ -0,0 +1,329 @@
+package pgcache
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/btree"
+	"github.com/lovego/sorted_sets"
+)
+
+// RangeIndex is an ordered index of table rows backed by a B-tree, for range queries such as
+// "rows with valid_from between X and Y". The rows are ordered by the "MapKeys" fields, which
+// compose K as the keys of a map do. The rows of the same key are kept as a sorted set, so
+// "SortedSetUniqueKey" is required if V is a struct. Use RangeIndex.Data as an element of
+// Table.Datas to keep it up to date, for example:
+//
+//	prices := pgcache.NewRangeIndex[float64, Product](pgcache.Data{
+//		MapKeys: []string{"Price"}, SortedSetUniqueKey: []string{"Id"},
+//	})
+//	dbCache.Add(&pgcache.Table{
+//		Name: "products", RowStruct: Product{}, Datas: []*pgcache.Data{prices.Data()},
+//	})
+//	prices.AscendRange(10, 20, func(price float64, product Product) bool { ... })
+//
+// K should be an integer, float, string, time.Time, or a struct of them compared field by field.
+type RangeIndex[K comparable, V any] struct {
+	mutex sync.RWMutex
+	tree  *btree.BTreeG[rangeItem[K, V]]
+	// the number of values.
+	count int
+	data  *Data
+	cmp   func(a, b reflect.Value) int
+	err   error
+	// a placeholder for Data.DataPtr, it's never filled.
+	placeholder map[K][]V
+}
+
+type rangeItem[K comparable, V any] struct {
+	key    K
+	values []V
+}
+
+// the degree of the B-tree.
+const rangeIndexDegree = 32
+
+// NewRangeIndex creates a RangeIndex. The fields of data describe how to store rows as Data does,
+// except that DataPtr and RWMutex are set by NewRangeIndex.
+func NewRangeIndex[K comparable, V any](data Data) *RangeIndex[K, V] {
+	m := &RangeIndex[K, V]{}
+	m.cmp, m.err = compareFunc(reflect.TypeOf(&m.placeholder).Elem().Key())
+	m.tree = m.newTree()
+	data.DataPtr = &m.placeholder
+	data.RWMutex = &m.mutex
+	data.container = m
+	m.data = &data
+	return m
+}
+
+// Data returns the Data to put into Table.Datas.
+func (m *RangeIndex[K, V]) Data() *Data {
+	return m.data
+}
+
+// Len returns the number of values.
+func (m *RangeIndex[K, V]) Len() int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.count
+}
+
+// AscendRange calls f for each value whose key is in [greaterOrEqual, lessThan) in ascending order,
+// until f returns false. The read lock is held during AscendRange, so f should be fast.
+func (m *RangeIndex[K, V]) AscendRange(greaterOrEqual, lessThan K, f func(key K, value V) bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	m.tree.AscendRange(
+		rangeItem[K, V]{key: greaterOrEqual}, rangeItem[K, V]{key: lessThan}, ascendValues(f),
+	)
+}
+
+// AscendGreaterOrEqual calls f for each value whose key is not less than pivot in ascending order,
+// until f returns false.
+func (m *RangeIndex[K, V]) AscendGreaterOrEqual(pivot K, f func(key K, value V) bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	m.tree.AscendGreaterOrEqual(rangeItem[K, V]{key: pivot}, ascendValues(f))
+}
+
+// DescendRange calls f for each value whose key is in (greaterThan, lessOrEqual] in descending
+// order, until f returns false. The values of the same key are in descending order too.
+func (m *RangeIndex[K, V]) DescendRange(lessOrEqual, greaterThan K, f func(key K, value V) bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	m.tree.DescendRange(
+		rangeItem[K, V]{key: lessOrEqual}, rangeItem[K, V]{key: greaterThan}, descendValues(f),
+	)
+}
+
+// DescendLessOrEqual calls f for each value whose key is not greater than pivot in descending
+// order, until f returns false.
+func (m *RangeIndex[K, V]) DescendLessOrEqual(pivot K, f func(key K, value V) bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	m.tree.DescendLessOrEqual(rangeItem[K, V]{key: pivot}, descendValues(f))
+}
+
+// Floor returns the greatest key not greater than key, and the values of it.
+func (m *RangeIndex[K, V]) Floor(key K) (K, []V, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var result rangeItem[K, V]
+	var ok bool
+	m.tree.DescendLessOrEqual(rangeItem[K, V]{key: key}, func(item rangeItem[K, V]) bool {
+		result, ok = item, true
+		return false
+	})
+	return result.key, append([]V(nil), result.values...), ok
+}
+
+// Ceiling returns the least key not less than key, and the values of it.
+func (m *RangeIndex[K, V]) Ceiling(key K) (K, []V, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var result rangeItem[K, V]
+	var ok bool
+	m.tree.AscendGreaterOrEqual(rangeItem[K, V]{key: key}, func(item rangeItem[K, V]) bool {
+		result, ok = item, true
+		return false
+	})
+	return result.key, append([]V(nil), result.values...), ok
+}
+
+// Page returns at most limit values whose key is not less than greaterOrEqual in ascending order,
+// after skipping offset values.
+func (m *RangeIndex[K, V]) Page(greaterOrEqual K, offset, limit int) []V {
+	var result []V
+	if limit <= 0 {
+		return result
+	}
+	m.AscendGreaterOrEqual(greaterOrEqual, func(key K, value V) bool {
+		if offset > 0 {
+			offset--
+			return true
+		}
+		result = append(result, value)
+		return len(result) < limit
+	})
+	return result
+}
+
+func ascendValues[K comparable, V any](f func(key K, value V) bool) btree.ItemIteratorG[rangeItem[K, V]] {
+	return func(item rangeItem[K, V]) bool {
+		for _, value := range item.values {
+			if !f(item.key, value) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func descendValues[K comparable, V any](f func(key K, value V) bool) btree.ItemIteratorG[rangeItem[K, V]] {
+	return func(item rangeItem[K, V]) bool {
+		for i := len(item.values) - 1; i >= 0; i-- {
+			if !f(item.key, item.values[i]) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func (m *RangeIndex[K, V]) newTree() *btree.BTreeG[rangeItem[K, V]] {
+	return btree.NewG(rangeIndexDegree, func(a, b rangeItem[K, V]) bool {
+		return m.cmp(reflect.ValueOf(a.key), reflect.ValueOf(b.key)) < 0
+	})
+}
+
+func (m *RangeIndex[K, V]) check(d *Data, rowStruct reflect.Type) error {
+	if m.err != nil {
+		return m.err
+	}
+	if len(d.mapKeys) != 1 {
+		return fmt.Errorf("RangeIndex: Data.MapKeys should compose %T.", *new(K))
+	}
+	return nil
+}
+
+func (m *RangeIndex[K, V]) save(d *Data, row reflect.Value) {
+	d.eachMapKey(row, 0, func(keyV reflect.Value) {
+		item := rangeItem[K, V]{key: keyV.Interface().(K)}
+		old, _ := m.tree.Get(item)
+		values := sorted_sets.SaveValue(
+			reflect.ValueOf(old.values), d.getValue(row), d.SortedSetUniqueKey...,
+		)
+		item.values = values.Interface().([]V)
+		m.count += len(item.values) - len(old.values)
+		m.tree.ReplaceOrInsert(item)
+	})
+}
+
+func (m *RangeIndex[K, V]) remove(d *Data, row reflect.Value) {
+	d.eachMapKey(row, 0, func(keyV reflect.Value) {
+		item, ok := m.tree.Get(rangeItem[K, V]{key: keyV.Interface().(K)})
+		if !ok {
+			return
+		}
+		values := sorted_sets.RemoveValue(
+			reflect.ValueOf(item.values), d.getValue(row), d.SortedSetUniqueKey...,
+		)
+		m.count -= len(item.values)
+		if !values.IsValid() || values.Len() == 0 {
+			m.tree.Delete(item)
+			return
+		}
+		item.values = values.Interface().([]V)
+		m.count += len(item.values)
+		m.tree.ReplaceOrInsert(item)
+	})
+}
+
+func (m *RangeIndex[K, V]) clear() {
+	m.tree, m.count = m.newTree(), 0
+}
+
+func (m *RangeIndex[K, V]) build(d *Data, rows reflect.Value) reflect.Value {
+	shadow := *d
+	index := &RangeIndex[K, V]{cmp: m.cmp}
+	index.tree = index.newTree()
+	shadow.container = index
+	for i := 0; i < rows.Len(); i++ {
+		shadow.saveLocked(rows.Index(i))
+	}
+	return reflect.ValueOf(index)
+}
+
+func (m *RangeIndex[K, V]) replace(container reflect.Value) {
+	index := container.Interface().(*RangeIndex[K, V])
+	m.tree, m.count = index.tree, index.count
+}
+
+func (m *RangeIndex[K, V]) publish() {
+}
+
+func (m *RangeIndex[K, V]) size() int {
+	return m.Len()
+}
+
+func (m *RangeIndex[K, V]) value() reflect.Value {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	result := make([]V, 0, m.count)
+	m.tree.Ascend(func(item rangeItem[K, V]) bool {
+		result = append(result, item.values...)
+		return true
+	})
+	return reflect.ValueOf(result)
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// compareFunc returns a function to compare two values of typ, which returns a negative number if
+// a < b, zero if a == b, or a positive number if a > b.
+func compareFunc(typ reflect.Type) (func(a, b reflect.Value) int, error) {
+	switch typ.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return func(a, b reflect.Value) int {
+			return compareOrdered(a.Int(), b.Int())
+		}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return func(a, b reflect.Value) int {
+			return compareOrdered(a.Uint(), b.Uint())
+		}, nil
+	case reflect.Float32, reflect.Float64:
+		return func(a, b reflect.Value) int {
+			return compareOrdered(a.Float(), b.Float())
+		}, nil
+	case reflect.String:
+		return func(a, b reflect.Value) int {
+			return strings.Compare(a.String(), b.String())
+		}, nil
+	case reflect.Struct:
+		if typ == timeType {
+			return func(a, b reflect.Value) int {
+				at, bt := a.Interface().(time.Time), b.Interface().(time.Time)
+				switch {
+				case at.Before(bt):
+					return -1
+				case at.After(bt):
+					return 1
+				}
+				return 0
+			}, nil
+		}
+		var fields = make([]func(a, b reflect.Value) int, typ.NumField())
+		for i := range fields {
+			if typ.Field(i).PkgPath != "" {
+				return nil, fmt.Errorf("RangeIndex: field %s of %v is not exported.", typ.Field(i).Name, typ)
+			}
+			cmp, err := compareFunc(typ.Field(i).Type)
+			if err != nil {
+				return nil, err
+			}
+			fields[i] = cmp
+		}
+		return func(a, b reflect.Value) int {
+			for i, cmp := range fields {
+				if c := cmp(a.Field(i), b.Field(i)); c != 0 {
+					return c
+				}
+			}
+			return 0
+		}, nil
+	}
+	return nil, fmt.Errorf("RangeIndex: %v is not an ordered type.", typ)
+}
+
+func compareOrdered[T int64 | uint64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
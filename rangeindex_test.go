@@ -0,0 +1,79 @@
+package pgcache
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+type priceRow struct {
+	Id        int
+	Price     float64
+	ValidFrom time.Time
+}
+
+type priceKey struct {
+	Price float64
+	Id    int
+}
+
+func ExampleNewRangeIndex() {
+	m := NewRangeIndex[float64, priceRow](Data{
+		MapKeys: []string{"Price"}, SortedSetUniqueKey: []string{"Id"},
+	})
+	t := &Table{Name: "prices", RowStruct: priceRow{}, Datas: []*Data{m.Data()}}
+	if err := t.init("db", &verifyQuerier{}, testLogger); err != nil {
+		panic(err)
+	}
+	t.Clear()
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	t.Save([]priceRow{
+		{Id: 1, Price: 10, ValidFrom: day}, {Id: 2, Price: 20, ValidFrom: day},
+		{Id: 3, Price: 10, ValidFrom: day}, {Id: 4, Price: 30, ValidFrom: day},
+	})
+	var ids []string
+	collect := func(price float64, row priceRow) bool {
+		ids = append(ids, fmt.Sprint(price, ":", row.Id))
+		return true
+	}
+	m.AscendRange(10, 30, collect)
+	fmt.Println(ids)
+	ids = nil
+	m.DescendRange(30, 10, collect)
+	fmt.Println(ids)
+	fmt.Println(m.Floor(25))
+	fmt.Println(m.Ceiling(25))
+	fmt.Println(m.Page(10, 1, 2))
+
+	t.Remove([]priceRow{{Id: 1, Price: 10}, {Id: 4, Price: 30}})
+	fmt.Println(m.Len(), m.Data().Size())
+	fmt.Println(m.Page(0, 0, 10))
+	// Output:
+	// [10:1 10:3 20:2]
+	// [30:4 20:2]
+	// 20 [{2 20 2024-01-01 00:00:00 +0000 UTC}] true
+	// 30 [{4 30 2024-01-01 00:00:00 +0000 UTC}] true
+	// [{3 10 2024-01-01 00:00:00 +0000 UTC} {2 20 2024-01-01 00:00:00 +0000 UTC}]
+	// 2 2
+	// [{3 10 2024-01-01 00:00:00 +0000 UTC} {2 20 2024-01-01 00:00:00 +0000 UTC}]
+}
+
+func ExampleRangeIndex_compositeKeys() {
+	m := NewRangeIndex[priceKey, int](Data{MapKeys: []string{"Price", "Id"}, Value: "Id"})
+	fmt.Println(m.Data().init(reflect.TypeOf(priceRow{})))
+	m.Data().replace(m.Data().build(reflect.ValueOf([]priceRow{
+		{Id: 2, Price: 10}, {Id: 1, Price: 20}, {Id: 1, Price: 10},
+	})))
+	m.AscendGreaterOrEqual(priceKey{Price: 10, Id: 2}, func(key priceKey, id int) bool {
+		fmt.Println(key)
+		return true
+	})
+
+	_, err := compareFunc(reflect.TypeOf(struct{ A, B bool }{}))
+	fmt.Println(err)
+	// Output:
+	// <nil>
+	// {10 2}
+	// {20 1}
+	// RangeIndex: bool is not an ordered type.
+}
@@ -0,0 +1,238 @@
+package pgcache
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// the version of the snapshot file format.
+const snapshotVersion = 1
+
+// snapshotHeader is written before the rows in a snapshot file.
+type snapshotHeader struct {
+	Version int
+	// the fields and types of "RowStruct", a snapshot of a different "RowStruct" is not loaded.
+	RowType string
+	LoadSql string
+	// the id in "pgcache_changes" table which the rows have been updated to, used in ChangeLog mode.
+	Position int64
+	// the checksum of the table rows in db, used if not in ChangeLog mode.
+	Checksum string
+	Time     time.Time
+}
+
+// SaveSnapshot saves the table rows and the change position into "SnapshotFile", so they can be
+// loaded at the next startup instead of "LoadSql". Save it when the table is quiet, for example
+// periodically or before DB.Close. If not in ChangeLog mode, the rows are synced by Table.Sync
+// before saved, so the listener must support Sync, and it fails if the table is changed during
+// saving.
+func (t *Table) SaveSnapshot(ctx context.Context) error {
+	if t.SnapshotFile == "" {
+		return errors.New("SnapshotFile is empty.")
+	}
+	var header = snapshotHeader{
+		Version: snapshotVersion, RowType: typeSignature(t.rowStruct), LoadSql: t.LoadSql,
+		Time: time.Now(),
+	}
+	if t.changeLog {
+		// got before the rows, so the changes after it are always replayed.
+		if header.Position = atomic.LoadInt64(&t.changePosition); header.Position <= 0 {
+			return errors.New("save snapshot: no change position yet.")
+		}
+	} else {
+		checksum, err := t.checksum()
+		if err != nil {
+			return err
+		}
+		header.Checksum = checksum
+		// the changes committed before the checksum may not have been applied to the rows yet.
+		if err := t.Sync(ctx); err != nil {
+			return fmt.Errorf("save snapshot: %v", err)
+		}
+	}
+
+	rows := t.storedRows()
+
+	if !t.changeLog {
+		if checksum, err := t.checksum(); err != nil {
+			return err
+		} else if checksum != header.Checksum {
+			return errors.New("save snapshot: the table is changed during saving.")
+		}
+	}
+	return writeSnapshot(t.SnapshotFile, header, rows.Interface())
+}
+
+// writeSnapshot writes to a temporary file first, so an incomplete snapshot is never loaded.
+func writeSnapshot(path string, header snapshotHeader, rows interface{}) error {
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	encoder := gob.NewEncoder(w)
+	if err = encoder.Encode(header); err == nil {
+		if err = encoder.Encode(rows); err == nil {
+			err = w.Flush()
+		}
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("save snapshot: %v", err)
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// loadSnapshot loads the rows from "SnapshotFile", and checks if it's compatible with the table.
+func (t *Table) loadSnapshot() (snapshotHeader, reflect.Value, error) {
+	var header snapshotHeader
+	var rows = reflect.New(reflect.SliceOf(t.rowStruct))
+
+	file, err := os.Open(t.SnapshotFile)
+	if err != nil {
+		return header, rows.Elem(), err
+	}
+	defer file.Close()
+	decoder := gob.NewDecoder(bufio.NewReader(file))
+	if err := decoder.Decode(&header); err != nil {
+		return header, rows.Elem(), fmt.Errorf("load snapshot: %v", err)
+	}
+	switch {
+	case header.Version != snapshotVersion:
+		return header, rows.Elem(), fmt.Errorf("load snapshot: unknown version %d", header.Version)
+	case header.RowType != typeSignature(t.rowStruct):
+		return header, rows.Elem(), errors.New("load snapshot: RowStruct is changed.")
+	case header.LoadSql != t.LoadSql:
+		return header, rows.Elem(), errors.New("load snapshot: LoadSql is changed.")
+	}
+	if err := decoder.Decode(rows.Interface()); err != nil {
+		return header, rows.Elem(), fmt.Errorf("load snapshot: %v", err)
+	}
+	return header, rows.Elem(), nil
+}
+
+// loadFreshSnapshot loads the snapshot if the checksum of the table is not changed since it's
+// saved, returns false if it's not loaded.
+func (t *Table) loadFreshSnapshot() bool {
+	header, rows, err := t.loadSnapshot()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			t.Error(err)
+		}
+		return false
+	}
+	if checksum, err := t.checksum(); err != nil {
+		t.Error(err)
+		return false
+	} else if checksum != header.Checksum {
+		return false
+	}
+	t.replaceRows(rows)
+	t.publish(Change{Action: "RELOAD"})
+	return true
+}
+
+// Resume loads the snapshot in ChangeLog mode, and returns the change position of it.
+// The listener replays the changes after the position, or calls Init if they have been pruned.
+func (t *Table) Resume(table string) (int64, bool) {
+	if t.SnapshotFile == "" {
+		return 0, false
+	}
+	header, rows, err := t.loadSnapshot()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			t.Error(err)
+		}
+		return 0, false
+	}
+	if header.Position <= 0 {
+		return 0, false
+	}
+	t.replaceRows(rows)
+	t.publish(Change{Action: "RELOAD"})
+	atomic.StoreInt64(&t.changePosition, header.Position)
+	return header.Position, true
+}
+
+// Position records the change position which the Datas have been updated to.
+func (t *Table) Position(table string, position int64) {
+	atomic.StoreInt64(&t.changePosition, position)
+}
+
+// the sql expression of the count and the sum of row hashes of table "t".
+const rowsChecksumSql = `count(*) || ':' || ` +
+	`coalesce(sum(('x' || substr(md5(t::text), 1, 16))::bit(64)::bigint), 0)`
+
+// checksum returns the row count and the sum of the row hashes of "LoadSql".
+func (t *Table) checksum() (string, error) {
+	var checksum string
+	if err := t.dbQuerier.Query(&checksum, fmt.Sprintf(
+		"SELECT %s FROM (%s) AS t", rowsChecksumSql, t.LoadSql,
+	)); err != nil {
+		return "", fmt.Errorf("checksum: %v", err)
+	}
+	return checksum, nil
+}
+
+// typeSignature describes the exported fields and their types of a type recursively.
+func typeSignature(typ reflect.Type) string {
+	var b strings.Builder
+	writeTypeSignature(&b, typ, make(map[reflect.Type]bool))
+	return b.String()
+}
+
+func writeTypeSignature(b *strings.Builder, typ reflect.Type, visited map[reflect.Type]bool) {
+	switch typ.Kind() {
+	case reflect.Ptr:
+		b.WriteString("*")
+		writeTypeSignature(b, typ.Elem(), visited)
+	case reflect.Slice:
+		b.WriteString("[]")
+		writeTypeSignature(b, typ.Elem(), visited)
+	case reflect.Array:
+		fmt.Fprintf(b, "[%d]", typ.Len())
+		writeTypeSignature(b, typ.Elem(), visited)
+	case reflect.Map:
+		b.WriteString("map[")
+		writeTypeSignature(b, typ.Key(), visited)
+		b.WriteString("]")
+		writeTypeSignature(b, typ.Elem(), visited)
+	case reflect.Struct:
+		// the types encoded by themselves, such as time.Time and decimal.Decimal.
+		if typ.Implements(gobEncoderType) || reflect.PtrTo(typ).Implements(gobEncoderType) ||
+			visited[typ] {
+			b.WriteString(typ.String())
+			return
+		}
+		visited[typ] = true
+		b.WriteString("{")
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if field.PkgPath != "" && !field.Anonymous {
+				continue
+			}
+			b.WriteString(field.Name)
+			b.WriteString(" ")
+			writeTypeSignature(b, field.Type, visited)
+			b.WriteString(";")
+		}
+		b.WriteString("}")
+		delete(visited, typ)
+	default:
+		b.WriteString(typ.String())
+	}
+}
+
+var gobEncoderType = reflect.TypeOf((*gob.GobEncoder)(nil)).Elem()
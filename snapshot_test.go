@@ -0,0 +1,142 @@
+package pgcache
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+)
+
+type snapshotQuerier struct {
+	checksum *string
+}
+
+func (q snapshotQuerier) Query(data interface{}, sql string, args ...interface{}) error {
+	switch data := data.(type) {
+	case *string:
+		*data = *q.checksum
+	case *[]Score:
+		*data = []Score{{StudentId: 1000, Subject: "语文", Score: 90}}
+	}
+	return nil
+}
+
+func (q snapshotQuerier) GetDB() *sql.DB {
+	return nil
+}
+
+// syncListener calls "sync" on Sync, to apply the changes not notified yet.
+type syncListener struct {
+	Listener
+	sync func()
+}
+
+func (l syncListener) Sync(ctx context.Context, table string) error {
+	l.sync()
+	return nil
+}
+
+func ExampleTable_SaveSnapshot() {
+	dir, err := os.MkdirTemp("", "pgcache")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var checksum = "1:123"
+	var newTable = func() (*Table, *map[int]map[string]int) {
+		var m map[int]map[string]int
+		var mutex sync.RWMutex
+		t := &Table{
+			Name: "scores", RowStruct: Score{}, PrimaryKeys: []string{"StudentId", "Subject"},
+			SnapshotFile: filepath.Join(dir, "scores.snapshot"),
+			Datas: []*Data{
+				{RWMutex: &mutex, DataPtr: &m, MapKeys: []string{"StudentId", "Subject"}, Value: "Score"},
+			},
+		}
+		if err := t.init("db", snapshotQuerier{&checksum}, testLogger); err != nil {
+			panic(err)
+		}
+		return t, &m
+	}
+
+	t, m := newTable()
+	t.Init("") // no snapshot, loaded by LoadSql.
+	// Sync is not supported if the table is not added to a DB.
+	fmt.Println(t.SaveSnapshot(context.Background()))
+
+	// the row is committed, but not notified before SaveSnapshot, so it's applied by Sync.
+	checksum = "2:456"
+	t.db = &DB{tables: map[string]*Table{"scores": t}, listener: syncListener{sync: func() {
+		t.Create("", []byte(`{"StudentId": 1001, "Subject": "语文", "Score": 95}`))
+	}}}
+	fmt.Println(t.SaveSnapshot(context.Background()), *m)
+
+	// the checksum is not changed, so the snapshot is loaded.
+	t, m = newTable()
+	t.Init("")
+	fmt.Println(*m)
+
+	// the checksum is changed, so it's loaded by LoadSql.
+	checksum = "2:789"
+	t, m = newTable()
+	t.Init("")
+	fmt.Println(*m)
+
+	// Output:
+	// save snapshot: pgcache: the table is not added to a DB.
+	// <nil> map[1000:map[语文:90] 1001:map[语文:95]]
+	// map[1000:map[语文:90] 1001:map[语文:95]]
+	// map[1000:map[语文:90]]
+}
+
+func ExampleTable_Resume() {
+	dir, err := os.MkdirTemp("", "pgcache")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var m map[int]map[string]int
+	var mutex sync.RWMutex
+	t := &Table{
+		Name: "scores", RowStruct: Score{}, PrimaryKeys: []string{"StudentId", "Subject"},
+		SnapshotFile: filepath.Join(dir, "scores.snapshot"), changeLog: true,
+		Datas: []*Data{
+			{RWMutex: &mutex, DataPtr: &m, MapKeys: []string{"StudentId", "Subject"}, Value: "Score"},
+		},
+	}
+	t.init("db", testQuerier{}, testLogger)
+	fmt.Println(t.Resume(""))
+	fmt.Println(t.SaveSnapshot(context.Background()))
+
+	t.Init("")
+	t.Position("", 100)
+	fmt.Println(t.SaveSnapshot(context.Background()))
+
+	t.Clear()
+	fmt.Println(t.Resume(""))
+	fmt.Println(m)
+
+	// Output:
+	// 0 false
+	// save snapshot: no change position yet.
+	// <nil>
+	// 100 true
+	// map[1000:map[语文:90]]
+}
+
+func Example_typeSignature() {
+	type Student struct {
+		Id     int64
+		Name   string
+		Scores []Score
+		secret string
+	}
+	fmt.Println(typeSignature(reflect.TypeOf(Student{})))
+	// Output:
+	// {Id int64;Name string;Scores []{StudentId int;Subject string;Score int;};}
+}
@@ -0,0 +1,101 @@
+package pgcache
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// Change is a change of a table, which is delivered to the subscribers after Datas are updated.
+type Change struct {
+	// INSERT, UPDATE, DELETE, TRUNCATE or RELOAD.
+	// RELOAD means that all rows may have changed, so the subscriber should rebuild its state from
+	// the Datas. It's delivered after the table is reloaded, or some changes are dropped because the
+	// subscriber is too slow.
+	Action string
+	Old    interface{} // the old row of "RowStruct" type, present for UPDATE and DELETE.
+	New    interface{} // the new row of "RowStruct" type, present for INSERT and UPDATE.
+}
+
+// the max number of changes queued for a subscriber.
+const subscriberQueueSize = 1000
+
+type subscriber struct {
+	f     func(Change)
+	queue chan Change
+	// set to 1 if some changes are dropped because the queue is full.
+	dropped int32
+}
+
+// Subscribe calls f with the changes of the table in order, after the Datas are updated. f is
+// called in a seperate goroutine, so a slow subscriber doesn't block the updating of Datas. If
+// the changes queued for f exceed 1000, the later ones are dropped and a RELOAD change is
+// delivered instead. Call the returned function to unsubscribe.
+func (t *Table) Subscribe(f func(Change)) (unsubscribe func()) {
+	s := &subscriber{f: f, queue: make(chan Change, subscriberQueueSize)}
+	t.subscribersMutex.Lock()
+	t.subscribers = append(t.subscribers, s)
+	t.subscribersMutex.Unlock()
+	go s.run()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.subscribersMutex.Lock()
+			defer t.subscribersMutex.Unlock()
+			for i := range t.subscribers {
+				if t.subscribers[i] == s {
+					t.subscribers = append(t.subscribers[:i], t.subscribers[i+1:]...)
+					break
+				}
+			}
+			close(s.queue)
+		})
+	}
+}
+
+// publish delivers the changes to the subscribers without blocking.
+func (t *Table) publish(changes ...Change) {
+	t.subscribersMutex.RLock()
+	defer t.subscribersMutex.RUnlock()
+	for _, s := range t.subscribers {
+		for _, change := range changes {
+			s.push(change)
+		}
+	}
+}
+
+func (t *Table) publishRows(action string, old, new reflect.Value) {
+	var change = Change{Action: action}
+	if old.IsValid() {
+		change.Old = old.Interface()
+	}
+	if new.IsValid() {
+		change.New = new.Interface()
+	}
+	t.publish(change)
+}
+
+func (s *subscriber) push(change Change) {
+	select {
+	case s.queue <- change:
+	default:
+		atomic.StoreInt32(&s.dropped, 1)
+		// if the queue is still full, the flag is checked after the queued changes are delivered.
+		select {
+		case s.queue <- Change{}:
+		default:
+		}
+	}
+}
+
+func (s *subscriber) run() {
+	for change := range s.queue {
+		if change.Action != "" {
+			s.f(change)
+		}
+		if len(s.queue) == 0 && atomic.SwapInt32(&s.dropped, 0) == 1 {
+			s.f(Change{Action: "RELOAD"})
+		}
+	}
+}
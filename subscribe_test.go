@@ -0,0 +1,72 @@
+package pgcache
+
+import (
+	"fmt"
+	"sync"
+)
+
+func ExampleTable_Subscribe() {
+	var m map[int]map[string]int
+	var mutex sync.RWMutex
+	t := &Table{
+		Name:      "scores",
+		RowStruct: Score{},
+		Datas: []*Data{
+			{RWMutex: &mutex, DataPtr: &m, MapKeys: []string{"StudentId", "Subject"}, Value: "Score"},
+		},
+	}
+	t.init("db", testQuerier{}, testLogger)
+
+	changes := make(chan Change)
+	unsubscribe := t.Subscribe(func(change Change) {
+		changes <- change
+	})
+	t.Init("")
+	fmt.Println(<-changes)
+	t.Create("", []byte(`{"StudentId": 1001, "Subject": "语文", "Score": 95}`))
+	fmt.Println(<-changes)
+	t.Update("",
+		[]byte(`{"StudentId": 1001, "Subject": "语文", "Score": 95}`),
+		[]byte(`{"StudentId": 1001, "Subject": "语文", "Score": 96}`),
+	)
+	fmt.Println(<-changes)
+	t.Delete("", []byte(`{"StudentId": 1001, "Subject": "语文", "Score": 96}`))
+	fmt.Println(<-changes)
+	t.Truncate("")
+	fmt.Println(<-changes)
+
+	unsubscribe()
+	t.Truncate("")
+	fmt.Println(len(t.subscribers))
+	// Output:
+	// {RELOAD <nil> <nil>}
+	// {INSERT <nil> {1001 语文 95}}
+	// {UPDATE {1001 语文 95} {1001 语文 96}}
+	// {DELETE {1001 语文 96} <nil>}
+	// {TRUNCATE <nil> <nil>}
+	// 0
+}
+
+func ExampleTable_Subscribe_slow() {
+	changes := make(chan Change)
+	block := make(chan struct{})
+	s := &subscriber{queue: make(chan Change, 1), f: func(change Change) {
+		<-block
+		changes <- change
+	}}
+	go s.run()
+
+	s.push(Change{Action: "INSERT", New: 1})
+	block <- struct{}{} // the first one is being delivered.
+	s.push(Change{Action: "INSERT", New: 2})
+	s.push(Change{Action: "INSERT", New: 3}) // dropped
+	close(block)
+	fmt.Println(<-changes)
+	fmt.Println(<-changes)
+	fmt.Println(<-changes)
+	close(s.queue)
+	// Output:
+	// {INSERT <nil> 1}
+	// {INSERT <nil> 2}
+	// {RELOAD <nil> <nil>}
+}
@@ -1,21 +1,27 @@
 package pgcache
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"reflect"
+	"sync"
 	"time"
 
 	"github.com/lovego/bsql"
 	"github.com/lovego/bsql/scan"
 	"github.com/lovego/pgcache/manage"
+	"github.com/lovego/pgcache/pglistener"
 	"github.com/lovego/value"
 )
 
 // A Handler to cache table data.
 type Table struct {
 	dbName string
+	// the DB which the table is added to.
+	db *DB
 
 	// The name of the table to cache, required.
 	Name string
@@ -30,7 +36,8 @@ type Table struct {
 	Columns string
 
 	// The big columns of the table to cache. It's got by a seperate query.
-	// Warning: when update, it will not be set on the old value.
+	// Warning: when update, it will not be set on the old value, unless the rows by primary key are
+	// maintained.
 	BigColumns string
 	// The unique fields to load "BigColumns" from db. If empty, and "RowStruct" has a "Id" Field,
 	// it's used as "BigColumnsLoadKeys".
@@ -38,6 +45,21 @@ type Table struct {
 	// sql to load "BigColumns"
 	bigColumnsLoadSql string
 
+	// KeyOnly makes the trigger notify only the "PrimaryKeys" columns, and the full rows are loaded
+	// by one "WHERE (primary keys) IN (...)" query for a burst of notifications. Use it if a row
+	// may exceed the 8000 bytes pg_notify payload limit.
+	KeyOnly bool
+	// The primary key fields of "RowStruct". Required if "KeyOnly", "SnapshotFile" or
+	// "VerifyInterval" is set, the table is polled, or some Data is an Aggregate, and then if it's
+	// empty and "RowStruct" has a "Id" Field, it's used as "PrimaryKeys".
+	// If it's set or required, the table rows are kept by it, so the exact old rows are removed
+	// from Datas on update or delete, and new Datas can be built from them.
+	PrimaryKeys []string
+	// comma seperated columns of "PrimaryKeys"
+	primaryKeyColumns string
+	// a struct type composed of "PrimaryKeys" fields, used as the key of "rows".
+	primaryKeyType reflect.Type
+
 	// The sql used to load initial data when a table is cached, or reload table data when the db
 	// connection lost. If empty, "Columns" and "BigColumns" is used to make a SELECT sql FROM "NAME".
 	LoadSql string
@@ -45,6 +67,38 @@ type Table struct {
 	// Datas is the maps to store table rows.
 	Datas []*Data
 
+	// SnapshotFile is the file to save the table rows by SaveSnapshot, and to load them at startup
+	// instead of "LoadSql". In ChangeLog mode the changes after the snapshot are replayed, otherwise
+	// the snapshot is used only if the checksum of the table is not changed.
+	// The table rows are kept by "PrimaryKeys" if it's set.
+	SnapshotFile string
+
+	// If Polling is not nil, the changes of the table are polled by a version column, instead of
+	// triggers and LISTEN/NOTIFY. If Polling.KeyColumns is empty, the columns of "PrimaryKeys" are
+	// used. A polled table keeps its rows by "PrimaryKeys", since only the keys of the old rows are
+	// polled.
+	Polling *pglistener.PollOptions
+	// whether the table is polled, by "Polling" or Options.Polling.
+	polled bool
+
+	// VerifyInterval enables verifying the table in background if it's positive. In each round, the
+	// checksums of the loaded columns in db and cache are compared by buckets of "PrimaryKeys", and
+	// the buckets whose checksums differ are compared row by row and repaired. The loaded fields
+	// should be integers, floats, strings, bools, time.Time or pointers to them, the "PrimaryKeys"
+	// should be integers or strings, and the table rows are kept by them.
+	VerifyInterval time.Duration
+	// The number of buckets to verify the table, 64 by default.
+	VerifyBuckets int
+	verifier      *verifier
+	// the fields and the sql expressions of their columns to compute the checksums of rows.
+	checksumFields, checksumColumns []string
+	// the Datas are LazyMaps, so the table is not loaded as a whole.
+	lazy bool
+	// whether the changes are logged into "pgcache_changes" table.
+	changeLog bool
+	// the id in "pgcache_changes" table which the Datas have been updated to, used in ChangeLog mode.
+	changePosition int64
+
 	// db querier to load data from a table.
 	dbQuerier DBQuerier
 
@@ -52,25 +106,108 @@ type Table struct {
 	logger Logger
 
 	rowStruct reflect.Type
+
+	// rows by primary key, maintained if "PrimaryKeys" is set or required, and the Datas are not
+	// LazyMaps.
+	rows map[interface{}]reflect.Value
+	// whether rows by primary key are maintained.
+	keepingRows bool
+	// primary keys notified but not loaded yet, only used in "KeyOnly" mode.
+	pendingKeys map[interface{}]reflect.Value
+	rowsMutex   sync.Mutex
+	// held for reading while the Datas are updated, and for writing by AddData and RemoveData.
+	// It's locked before rowsMutex.
+	datasMutex sync.RWMutex
+
+	subscribers      []*subscriber
+	subscribersMutex sync.RWMutex
+}
+
+// Sync waits until the changes of the table committed before it have been applied to the Datas.
+// See DB.Sync.
+func (t *Table) Sync(ctx context.Context) error {
+	if t.db == nil {
+		return errors.New("pgcache: the table is not added to a DB.")
+	}
+	return t.db.Sync(ctx, t.Name)
 }
 
 func (t *Table) Init(table string) {
+	if t.SnapshotFile != "" && !t.changeLog && t.loadFreshSnapshot() {
+		return
+	}
 	if err := t.Reload(); err != nil {
 		t.Error(err)
 	}
 }
 
 func (t *Table) Create(table string, content []byte) {
-	t.save(content)
+	if t.KeyOnly {
+		t.addPendingKey(content)
+		return
+	}
+	if row, ok := t.decodeRow(content, true); ok {
+		t.datasMutex.RLock()
+		unlock := t.lockRows()
+		t.saveRow(row, false)
+		unlock()
+		t.datasMutex.RUnlock()
+		t.publishRows("INSERT", reflect.Value{}, row)
+	}
 }
 
 func (t *Table) Update(table string, oldContent, newContent []byte) {
-	t.remove(oldContent)
-	t.save(newContent)
+	if t.KeyOnly {
+		t.addPendingKey(oldContent)
+		t.addPendingKey(newContent)
+		return
+	}
+	oldRow, oldOk := t.decodeRow(oldContent, false)
+	newRow, newOk := t.decodeRow(newContent, true)
+	// the old row and the new row are changed under one lock,
+	// so readers never see a state with neither of them.
+	t.datasMutex.RLock()
+	unlockRows := t.lockRows()
+	unlock := t.lockDatas()
+	if oldOk {
+		oldRow, oldOk = t.removeRow(oldRow, true)
+	}
+	if !oldOk {
+		oldRow = reflect.Value{}
+	}
+	if newOk {
+		t.saveRow(newRow, true)
+	} else {
+		newRow = reflect.Value{}
+	}
+	unlock()
+	unlockRows()
+	t.datasMutex.RUnlock()
+	if oldOk || newOk {
+		t.publishRows("UPDATE", oldRow, newRow)
+	}
 }
 
 func (t *Table) Delete(table string, content []byte) {
-	t.remove(content)
+	if t.KeyOnly {
+		t.addPendingKey(content)
+		return
+	}
+	if row, ok := t.decodeRow(content, false); ok {
+		t.datasMutex.RLock()
+		unlock := t.lockRows()
+		row, ok = t.removeRow(row, false)
+		unlock()
+		t.datasMutex.RUnlock()
+		if ok {
+			t.publishRows("DELETE", row, reflect.Value{})
+		}
+	}
+}
+
+func (t *Table) Truncate(table string) {
+	t.Clear()
+	t.publish(Change{Action: "TRUNCATE"})
 }
 
 func (t *Table) ConnLoss(table string) {
@@ -81,7 +218,22 @@ func (t *Table) ConnLoss(table string) {
 	}
 }
 
+// BulkChange reloads the table when a statement changed too many rows to be notified.
+// It's called by the listener in StatementLevel mode.
+func (t *Table) BulkChange(table string, op string, rows int64) {
+	if err := t.Reload(); err != nil {
+		t.Error(fmt.Sprintf("bulk %s of %d rows: %v", op, rows, err))
+	}
+}
+
+// Reload loads all the rows by "LoadSql" and replaces the Datas. If the Datas are LazyMaps, it
+// just evicts all the keys, so they are loaded again when they're got.
 func (t *Table) Reload() error {
+	if t.lazy {
+		t.Clear()
+		t.publish(Change{Action: "RELOAD"})
+		return nil
+	}
 	var rows = reflect.New(reflect.SliceOf(t.rowStruct)).Elem()
 	start := time.Now()
 	err := t.dbQuerier.Query(rows.Addr().Interface(), t.LoadSql)
@@ -90,40 +242,176 @@ func (t *Table) Reload() error {
 		log.Printf("%s \t%s.%s\n", msg, t.dbName, t.Name)
 		return fmt.Errorf("reload: %v", err)
 	}
-	t.Clear()
-	t.Save(rows.Interface())
+	t.replaceRows(rows)
+	t.publish(Change{Action: "RELOAD"})
 	log.Printf("%s fullTime: %6v, \t%s.%s\n", msg, time.Since(start).Round(time.Millisecond),
 		t.dbName, t.Name)
 	return nil
 }
 
+// replaceRows replaces all the rows of Datas. The new containers are built aside, then swapped in
+// under the locks of Datas, so readers never see empty or partially filled Datas.
+func (t *Table) replaceRows(rows reflect.Value) {
+	t.datasMutex.RLock()
+	defer t.datasMutex.RUnlock()
+	var containers = make([]reflect.Value, len(t.Datas))
+	for i, d := range t.Datas {
+		containers[i] = d.build(rows)
+	}
+	var keyRows map[interface{}]reflect.Value
+	if t.keepRows() {
+		keyRows = make(map[interface{}]reflect.Value, rows.Len())
+		for i := 0; i < rows.Len(); i++ {
+			row := rows.Index(i)
+			keyRows[t.primaryKey(row)] = row
+		}
+	}
+
+	unlockRows := t.lockRows()
+	defer unlockRows()
+	unlock := t.lockDatas()
+	defer unlock()
+	for i, d := range t.Datas {
+		d.replace(containers[i])
+	}
+	if keyRows != nil {
+		t.rows = keyRows
+	}
+}
+
 func (t *Table) Clear() {
+	t.datasMutex.RLock()
+	defer t.datasMutex.RUnlock()
+	unlock := t.lockRows()
+	defer unlock()
+	t.clearRows()
 	for _, d := range t.Datas {
 		d.clear()
 	}
 }
 
+// clearRows clears the rows by primary key, the caller should hold the lock of rows.
+func (t *Table) clearRows() {
+	if t.keepRows() {
+		t.rows = make(map[interface{}]reflect.Value)
+		t.pendingKeys = nil
+	}
+}
+
 func (t *Table) Save(rows interface{}) {
+	t.datasMutex.RLock()
+	defer t.datasMutex.RUnlock()
+	unlock := t.lockRows()
+	defer unlock()
 	rowsV := reflect.ValueOf(rows)
 	for i := 0; i < rowsV.Len(); i++ {
-		row := rowsV.Index(i)
-		for _, d := range t.Datas {
-			d.save(row)
-		}
+		t.saveRow(rowsV.Index(i), false)
 	}
 }
 
 func (t *Table) Remove(rows interface{}) {
+	t.datasMutex.RLock()
+	defer t.datasMutex.RUnlock()
+	unlock := t.lockRows()
+	defer unlock()
 	rowsV := reflect.ValueOf(rows)
 	for i := 0; i < rowsV.Len(); i++ {
-		row := rowsV.Index(i)
-		for _, d := range t.Datas {
+		t.removeRow(rowsV.Index(i), false)
+	}
+}
+
+// saveRow saves the row to Datas. If locked is true, the caller should hold the lock of Datas.
+func (t *Table) saveRow(row reflect.Value, locked bool) {
+	if t.keepRows() {
+		key := t.primaryKey(row)
+		if old, ok := t.rows[key]; ok {
+			// the old row is replaced under one lock, so readers never see neither of them.
+			if !locked {
+				unlock := t.lockDatas()
+				defer unlock()
+				locked = true
+			}
+			t.removeFromDatas(old, locked)
+		}
+		t.rows[key] = row
+	}
+	for _, d := range t.Datas {
+		if locked {
+			d.saveLocked(row)
+		} else {
+			d.save(row)
+		}
+	}
+}
+
+// removeRow removes the row from Datas. If locked is true, the caller should hold the lock of Datas.
+// If the rows by primary key are maintained, the row kept is removed and returned instead, and
+// false is returned if there is no such row.
+func (t *Table) removeRow(row reflect.Value, locked bool) (reflect.Value, bool) {
+	if t.keepRows() {
+		key := t.primaryKey(row)
+		if old, ok := t.rows[key]; ok {
+			row = old
+			delete(t.rows, key)
+		} else {
+			return row, false
+		}
+	}
+	t.removeFromDatas(row, locked)
+	return row, true
+}
+
+// requireRows reports whether the options or Datas which require the rows by primary key are set.
+func (t *Table) requireRows() bool {
+	if t.KeyOnly || t.SnapshotFile != "" || t.VerifyInterval > 0 || t.polled {
+		return true
+	}
+	for _, d := range t.Datas {
+		if d.countsRows() {
+			return true
+		}
+	}
+	return false
+}
+
+// keepRows reports whether the rows by primary key are maintained.
+func (t *Table) keepRows() bool {
+	return t.keepingRows
+}
+
+// storedRows returns a slice of the rows by primary key.
+func (t *Table) storedRows() reflect.Value {
+	t.rowsMutex.Lock()
+	defer t.rowsMutex.Unlock()
+	rows := reflect.MakeSlice(reflect.SliceOf(t.rowStruct), 0, len(t.rows))
+	for _, row := range t.rows {
+		rows = reflect.Append(rows, row)
+	}
+	return rows
+}
+
+// lockRows locks the rows by primary key if they are maintained, and returns a function to unlock.
+func (t *Table) lockRows() func() {
+	if !t.keepRows() {
+		return func() {}
+	}
+	t.rowsMutex.Lock()
+	return t.rowsMutex.Unlock
+}
+
+func (t *Table) removeFromDatas(row reflect.Value, locked bool) {
+	for _, d := range t.Datas {
+		if locked {
+			d.removeLocked(row)
+		} else {
 			d.remove(row)
 		}
 	}
 }
 
 func (t *Table) GetDatas() []manage.Data {
+	t.datasMutex.RLock()
+	defer t.datasMutex.RUnlock()
 	result := make([]manage.Data, len(t.Datas))
 	for i, data := range t.Datas {
 		result[i] = data
@@ -131,13 +419,95 @@ func (t *Table) GetDatas() []manage.Data {
 	return result
 }
 
-func (t *Table) save(content []byte) {
+// AddData adds a Data to a table which is being cached, it's shown on the manage page too.
+// The Data is built from the rows by primary key if they are maintained, otherwise from the rows
+// loaded by "LoadSql". The other Datas are not changed, and the changes of the table are applied
+// after the Data is built.
+func (t *Table) AddData(d *Data) error {
+	if t.rowStruct == nil {
+		return errors.New("AddData: the table is not added to a DB.")
+	}
+	if t.lazy || d.lazy != nil {
+		return errors.New("AddData: LazyMap can't be added.")
+	}
+	if err := d.init(t.rowStruct); err != nil {
+		return err
+	}
+	if d.countsRows() && !t.keepRows() {
+		return errors.New("AddData: Aggregate requires PrimaryKeys.")
+	}
+	t.datasMutex.Lock()
+	for _, data := range t.Datas {
+		if data.Key() == d.Key() {
+			t.datasMutex.Unlock()
+			return fmt.Errorf("AddData: %s aready exists.", d.Key())
+		}
+	}
+	if t.keepRows() {
+		container := d.build(t.storedRows())
+		d.Lock()
+		d.replace(container)
+		d.publish()
+		d.Unlock()
+		t.appendData(d)
+		t.datasMutex.Unlock()
+		return nil
+	}
+	// the rows are loaded outside the lock, so the changes of the table are not blocked.
+	// The changes during it are recorded by the Data, and applied after the rows loaded.
+	d.loading = true
+	t.appendData(d)
+	t.datasMutex.Unlock()
+
+	var rows = reflect.New(reflect.SliceOf(t.rowStruct)).Elem()
+	if err := t.dbQuerier.Query(rows.Addr().Interface(), t.LoadSql); err != nil {
+		t.RemoveData(d.Key())
+		return fmt.Errorf("AddData: %v", err)
+	}
+	container := d.build(rows)
+	d.Lock()
+	changes := d.pending
+	d.loading, d.pending = false, nil
+	d.replace(container)
+	for _, change := range changes {
+		change()
+	}
+	d.publish()
+	d.Unlock()
+	return nil
+}
+
+// appendData appends a Data, the caller should hold the write lock of datasMutex.
+func (t *Table) appendData(d *Data) {
+	// the Datas slice may be shared with the caller, so it's copied.
+	t.Datas = append(t.Datas[:len(t.Datas):len(t.Datas)], d)
+}
+
+// RemoveData removes a Data by its key, it's not updated any more after RemoveData returns.
+func (t *Table) RemoveData(key string) error {
+	t.datasMutex.Lock()
+	defer t.datasMutex.Unlock()
+	for i, d := range t.Datas {
+		if d.Key() == key {
+			if len(t.Datas) == 1 {
+				return errors.New("RemoveData: Datas should not be empty.")
+			}
+			datas := make([]*Data, 0, len(t.Datas)-1)
+			t.Datas = append(append(datas, t.Datas[:i]...), t.Datas[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("RemoveData: %s not found.", key)
+}
+
+// decodeRow decodes a row from the notified content, and loads "BigColumns" if required.
+func (t *Table) decodeRow(content []byte, loadBigColumns bool) (reflect.Value, bool) {
 	var row = reflect.New(t.rowStruct).Elem()
 	if err := jsonUnmarshal(content, row); err != nil {
 		t.Error(err)
-		return
+		return row, false
 	}
-	if t.BigColumns != "" {
+	if loadBigColumns && t.BigColumns != "" {
 		var params = make([]interface{}, len(t.BigColumnsLoadKeys))
 		for i, key := range t.BigColumnsLoadKeys {
 			params[i] = bsql.V(row.FieldByName(key).Interface())
@@ -146,23 +516,10 @@ func (t *Table) save(content []byte) {
 			t.bigColumnsLoadSql, params...,
 		)); err != nil {
 			t.Error(err)
-			return
+			return row, false
 		}
 	}
-	for _, d := range t.Datas {
-		d.save(row)
-	}
-}
-
-func (t *Table) remove(content []byte) {
-	var row = reflect.New(t.rowStruct).Elem()
-	if err := jsonUnmarshal(content, row); err != nil {
-		t.Error(err)
-		return
-	}
-	for _, d := range t.Datas {
-		d.remove(row)
-	}
+	return row, true
 }
 
 func (t *Table) Error(err interface{}) {
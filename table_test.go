@@ -64,6 +64,9 @@ func ExampleTable() {
 	t.Create("", []byte(`{"StudentId": 1001, "Subject": "语文", "Score": 95}`))
 	fmt.Println(m1, m2)
 
+	t.Truncate("")
+	fmt.Println(m1, m2)
+
 	// Output:
 	// map[1000:map[语文:90]] map[语文:map[1000:90]]
 	// map[1000:map[语文:90] 1001:map[语文:95]] map[语文:map[1000:90 1001:95]]
@@ -71,6 +74,144 @@ func ExampleTable() {
 	// map[1000:map[语文:90] 1001:map[]] map[数学:map[] 语文:map[1000:90]]
 	// map[] map[]
 	// map[1001:map[语文:95]] map[语文:map[1001:95]]
+	// map[] map[]
+}
+
+func ExampleTable_Reload() {
+	var m map[int]map[string]int
+	var mutex sync.RWMutex
+	t := &Table{
+		Name:      "scores",
+		RowStruct: Score{},
+		Datas: []*Data{
+			{RWMutex: &mutex, DataPtr: &m, MapKeys: []string{"StudentId", "Subject"}, Value: "Score"},
+		},
+	}
+	t.init("db", testQuerier{}, testLogger)
+	t.Init("")
+	t.Create("", []byte(`{"StudentId": 1001, "Subject": "语文", "Score": 95}`))
+	old := m
+
+	// the map is replaced by a new one, the old one is not cleared.
+	if err := t.Reload(); err != nil {
+		fmt.Println(err)
+	}
+	fmt.Println(old)
+	fmt.Println(m)
+	// Output:
+	// map[1000:map[语文:90] 1001:map[语文:95]]
+	// map[1000:map[语文:90]]
+}
+
+func ExampleTable_rows() {
+	var m map[int]string
+	var mutex sync.RWMutex
+	t := &Table{
+		Name: "scores", RowStruct: Score{}, PrimaryKeys: []string{"StudentId", "Subject"},
+		Datas: []*Data{{RWMutex: &mutex, DataPtr: &m, MapKeys: []string{"Score"}, Value: "Subject"}},
+	}
+	t.init("db", testQuerier{}, testLogger)
+	t.Init("")
+	changes := make(chan Change, 2)
+	t.Subscribe(func(change Change) { changes <- change })
+
+	// the old content has no "Score" (like a big column), the row kept by primary key is removed.
+	t.Update("",
+		[]byte(`{"StudentId": 1000, "Subject": "语文"}`),
+		[]byte(`{"StudentId": 1000, "Subject": "语文", "Score": 95}`),
+	)
+	change := <-changes
+	fmt.Println(m, change.Old, change.New)
+	t.Delete("", []byte(`{"StudentId": 1000, "Subject": "语文"}`))
+	change = <-changes
+	fmt.Println(m, change.Old, change.New)
+	// Output:
+	// map[95:语文] {1000 语文 90} {1000 语文 95}
+	// map[] {1000 语文 95} <nil>
+}
+
+func ExampleTable_AddData() {
+	var m1 map[int]map[string]int
+	var mutex sync.RWMutex
+	t := &Table{
+		Name: "scores", RowStruct: Score{}, PrimaryKeys: []string{"StudentId", "Subject"},
+		Datas: []*Data{
+			{RWMutex: &mutex, DataPtr: &m1, MapKeys: []string{"StudentId", "Subject"}, Value: "Score"},
+		},
+	}
+	t.init("db", testQuerier{}, testLogger)
+	t.Init("")
+	t.Create("", []byte(`{"StudentId": 1001, "Subject": "数学", "Score": 95}`))
+
+	// the new Data is built from the rows by primary key.
+	var m2 map[string]map[int]int
+	d := &Data{RWMutex: &mutex, DataPtr: &m2, MapKeys: []string{"Subject", "StudentId"}, Value: "Score"}
+	fmt.Println(t.AddData(d))
+	fmt.Println(m2)
+	fmt.Println(t.AddData(&Data{
+		RWMutex: &mutex, DataPtr: &m2, MapKeys: []string{"Subject", "StudentId"}, Value: "Score",
+	}))
+
+	t.Delete("", []byte(`{"StudentId": 1000, "Subject": "语文"}`))
+	fmt.Println(m1, m2)
+
+	fmt.Println(t.RemoveData(d.Key()))
+	t.Create("", []byte(`{"StudentId": 1002, "Subject": "语文", "Score": 80}`))
+	fmt.Println(m1, m2)
+	fmt.Println(t.RemoveData(d.Key()))
+	// Output:
+	// <nil>
+	// map[数学:map[1001:95] 语文:map[1000:90]]
+	// AddData: map[Subject:string]map[StudentId:int]Score:int aready exists.
+	// map[1000:map[] 1001:map[数学:95]] map[数学:map[1001:95] 语文:map[]]
+	// <nil>
+	// map[1000:map[] 1001:map[数学:95] 1002:map[语文:80]] map[数学:map[1001:95] 语文:map[]]
+	// RemoveData: map[Subject:string]map[StudentId:int]Score:int not found.
+}
+
+// loadingQuerier calls "loading" while loading the rows, to make changes during it.
+type loadingQuerier struct {
+	loading func()
+}
+
+func (q *loadingQuerier) Query(data interface{}, sql string, args ...interface{}) error {
+	if q.loading != nil {
+		q.loading()
+	}
+	return testQuerier{}.Query(data, sql, args...)
+}
+
+func (q *loadingQuerier) GetDB() *sql.DB {
+	return nil
+}
+
+func ExampleTable_AddData_load() {
+	var m1 map[int]map[string]int
+	var mutex sync.RWMutex
+	t := &Table{
+		Name: "scores", RowStruct: Score{},
+		Datas: []*Data{
+			{RWMutex: &mutex, DataPtr: &m1, MapKeys: []string{"StudentId", "Subject"}, Value: "Score"},
+		},
+	}
+	querier := &loadingQuerier{}
+	t.init("db", querier, testLogger)
+	t.Init("")
+
+	// the new Data is built from the rows loaded by "LoadSql" without holding the lock,
+	// the changes during it are applied after the rows loaded.
+	querier.loading = func() {
+		t.Create("", []byte(`{"StudentId": 1001, "Subject": "数学", "Score": 95}`))
+		t.Delete("", []byte(`{"StudentId": 1000, "Subject": "语文", "Score": 90}`))
+	}
+	var m2 map[string]map[int]int
+	fmt.Println(t.AddData(&Data{
+		RWMutex: &mutex, DataPtr: &m2, MapKeys: []string{"Subject", "StudentId"}, Value: "Score",
+	}))
+	fmt.Println(m1, m2)
+	// Output:
+	// <nil>
+	// map[1000:map[] 1001:map[数学:95]] map[数学:map[1001:95] 语文:map[]]
 }
 
 func ExamplePointerValue_1() {
@@ -47,11 +47,52 @@ func (t *Table) init(dbName string, dbQuerier DBQuerier, logger Logger) error {
 			return err
 		}
 	}
+	if err := t.initLazy(); err != nil {
+		return err
+	}
+	if len(t.PrimaryKeys) > 0 || t.requireRows() {
+		if err := t.initPrimaryKeys(); err != nil {
+			return err
+		}
+		t.keepingRows = !t.lazy
+	}
+	if t.VerifyInterval > 0 {
+		if err := t.checkVerifyKeys(); err != nil {
+			return err
+		}
+		if err := t.initChecksumFields(); err != nil {
+			return err
+		}
+	}
 	t.dbQuerier, t.logger = dbQuerier, logger
 
 	return nil
 }
 
+// initLazy checks and binds the LazyMaps of Datas.
+func (t *Table) initLazy() error {
+	var lazyCount int
+	for _, d := range t.Datas {
+		if d.lazy != nil {
+			if err := d.lazy.bind(t); err != nil {
+				return err
+			}
+			lazyCount++
+		}
+	}
+	if lazyCount == 0 {
+		return nil
+	}
+	if lazyCount < len(t.Datas) {
+		return errors.New("Datas should be all LazyMaps if one is.")
+	}
+	if t.requireRows() {
+		return errors.New("LazyMap can't be used with KeyOnly, SnapshotFile, VerifyInterval or Polling.")
+	}
+	t.lazy = true
+	return nil
+}
+
 func (t *Table) initBigColumns() error {
 	if len(t.BigColumnsLoadKeys) == 0 {
 		if _, ok := t.rowStruct.FieldByName("Id"); ok {
@@ -76,6 +117,33 @@ func (t *Table) initBigColumns() error {
 	return nil
 }
 
+func (t *Table) initPrimaryKeys() error {
+	if len(t.PrimaryKeys) == 0 {
+		if _, ok := t.rowStruct.FieldByName("Id"); ok {
+			t.PrimaryKeys = []string{"Id"}
+		} else {
+			return errors.New("PrimaryKeys is required.")
+		}
+	}
+	var fields []reflect.StructField
+	var columns []string
+	for _, name := range t.PrimaryKeys {
+		field, ok := t.rowStruct.FieldByName(name)
+		if !ok {
+			return fmt.Errorf(`illegal field "%s" in PrimaryKeys`, name)
+		}
+		if !field.Type.Comparable() {
+			return fmt.Errorf(`field "%s" in PrimaryKeys is not comparable`, name)
+		}
+		fields = append(fields, reflect.StructField{Name: field.Name, Type: field.Type})
+		columns = append(columns, Field2Column(name))
+	}
+	t.primaryKeyType = reflect.StructOf(fields)
+	t.primaryKeyColumns = strings.Join(columns, ",")
+	t.rows = make(map[interface{}]reflect.Value)
+	return nil
+}
+
 func columnsFromRowStruct(rowStruct reflect.Type, exclude string) string {
 	var excluding []string
 	if exclude != "" {
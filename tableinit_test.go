@@ -2,6 +2,7 @@ package pgcache
 
 import (
 	"fmt"
+	"sync"
 )
 
 func ExampleTable_init() {
@@ -41,3 +42,36 @@ func ExampleTable_init_bigColumns() {
 	// SELECT score FROM scores WHERE student_id = %s AND subject = %s
 	// SELECT student_id,subject ,score FROM scores
 }
+
+func ExampleTable_init_primaryKeys() {
+	type Student struct {
+		Id   int64
+		Name string
+	}
+	var m map[int64]string
+	var mutex sync.RWMutex
+	t := Table{
+		Name: "students", RowStruct: Student{},
+		Datas: []*Data{{RWMutex: &mutex, DataPtr: &m, MapKeys: []string{"Id"}, Value: "Name"}},
+	}
+	// the rows are not kept by "Id" if "PrimaryKeys" is not set or required.
+	fmt.Println(t.init("", testQuerier{}, testLogger), t.keepRows())
+
+	// a polled table requires the rows, since only the keys of the old rows are polled.
+	t = Table{
+		Name: "students", RowStruct: Student{}, polled: true,
+		Datas: []*Data{{RWMutex: &mutex, DataPtr: &m, MapKeys: []string{"Id"}, Value: "Name"}},
+	}
+	fmt.Println(t.init("", testQuerier{}, testLogger), t.keepRows(), t.PrimaryKeys)
+
+	t = Table{
+		Name: "students", RowStruct: Student{}, PrimaryKeys: []string{"Uid"},
+		Datas: []*Data{{RWMutex: &mutex, DataPtr: &m, MapKeys: []string{"Id"}, Value: "Name"}},
+	}
+	fmt.Println(t.init("", testQuerier{}, testLogger))
+
+	// Output:
+	// <nil> false
+	// <nil> true [Id]
+	// illegal field "Uid" in PrimaryKeys
+}
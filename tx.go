@@ -0,0 +1,118 @@
+package pgcache
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/lovego/pgcache/pglistener"
+)
+
+// ApplyTx applies the changes of a transaction. The lock of each Data is held only once during
+// the whole transaction, so readers never see a partially applied transaction.
+// It's called by the listener in Transactional mode.
+func (t *Table) ApplyTx(table string, changes []pglistener.Change) {
+	if t.KeyOnly {
+		// the changed rows are loaded and applied together by Flush.
+		for _, change := range changes {
+			t.applyChange(table, change)
+		}
+		return
+	}
+	t.datasMutex.RLock()
+	defer t.datasMutex.RUnlock()
+
+	type op struct {
+		action   string
+		old, new reflect.Value
+	}
+	// decode rows and load big columns before locking.
+	var ops = make([]op, 0, len(changes))
+	for _, change := range changes {
+		var o = op{action: change.Action}
+		var ok = true
+		switch change.Action {
+		case "INSERT":
+			o.new, ok = t.decodeRow(change.New, true)
+		case "UPDATE":
+			if o.old, ok = t.decodeRow(change.Old, false); ok {
+				o.new, ok = t.decodeRow(change.New, true)
+			}
+		case "DELETE":
+			o.old, ok = t.decodeRow(change.Old, false)
+		}
+		if ok {
+			ops = append(ops, o)
+		}
+	}
+
+	unlockRows := t.lockRows()
+	unlock := t.lockDatas()
+	for i := range ops {
+		o := &ops[i]
+		if o.action == "TRUNCATE" {
+			t.clearRows()
+			for _, d := range t.Datas {
+				d.clearLocked()
+			}
+			continue
+		}
+		if o.old.IsValid() {
+			if old, ok := t.removeRow(o.old, true); ok {
+				o.old = old
+			}
+		}
+		if o.new.IsValid() {
+			t.saveRow(o.new, true)
+		}
+	}
+	unlock()
+	unlockRows()
+
+	for _, o := range ops {
+		t.publishRows(o.action, o.old, o.new)
+	}
+}
+
+func (t *Table) applyChange(table string, change pglistener.Change) {
+	switch change.Action {
+	case "INSERT":
+		t.Create(table, change.New)
+	case "UPDATE":
+		t.Update(table, change.Old, change.New)
+	case "DELETE":
+		t.Delete(table, change.Old)
+	case "TRUNCATE":
+		t.Truncate(table)
+	}
+}
+
+// lockDatas locks the distinct mutexes of Datas, and returns a function to unlock them.
+// The caller should hold the read lock of datasMutex.
+func (t *Table) lockDatas() func() {
+	var mutexes []*sync.RWMutex
+	for _, d := range t.Datas {
+		if !containsMutex(mutexes, d.RWMutex) {
+			mutexes = append(mutexes, d.RWMutex)
+		}
+	}
+	for _, mutex := range mutexes {
+		mutex.Lock()
+	}
+	return func() {
+		for _, d := range t.Datas {
+			d.publish()
+		}
+		for i := len(mutexes) - 1; i >= 0; i-- {
+			mutexes[i].Unlock()
+		}
+	}
+}
+
+func containsMutex(mutexes []*sync.RWMutex, mutex *sync.RWMutex) bool {
+	for _, m := range mutexes {
+		if m == mutex {
+			return true
+		}
+	}
+	return false
+}
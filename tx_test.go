@@ -0,0 +1,46 @@
+package pgcache
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/lovego/pgcache/pglistener"
+)
+
+func ExampleTable_ApplyTx() {
+	var m1 map[int]map[string]int
+	var m2 map[string]map[int]int
+
+	var mutex sync.RWMutex
+	t := &Table{
+		Name:      "scores",
+		RowStruct: Score{},
+		Datas: []*Data{
+			{RWMutex: &mutex, DataPtr: &m1, MapKeys: []string{"StudentId", "Subject"}, Value: "Score"},
+			{RWMutex: &mutex, DataPtr: &m2, MapKeys: []string{"Subject", "StudentId"}, Value: "Score"},
+		},
+	}
+	t.init("db", testQuerier{}, testLogger)
+	t.Init("")
+
+	t.ApplyTx("", []pglistener.Change{
+		{Action: "INSERT", New: []byte(`{"StudentId": 1001, "Subject": "语文", "Score": 95}`)},
+		{
+			Action: "UPDATE",
+			Old:    []byte(`{"StudentId": 1000, "Subject": "语文", "Score": 90}`),
+			New:    []byte(`{"StudentId": 1000, "Subject": "数学", "Score": 92}`),
+		},
+		{Action: "DELETE", Old: []byte(`{"StudentId": 1001, "Subject": "语文", "Score": 95}`)},
+	})
+	fmt.Println(m1, m2)
+
+	t.ApplyTx("", []pglistener.Change{
+		{Action: "TRUNCATE"},
+		{Action: "INSERT", New: []byte(`{"StudentId": 1002, "Subject": "语文", "Score": 80}`)},
+	})
+	fmt.Println(m1, m2)
+
+	// Output:
+	// map[1000:map[数学:92] 1001:map[]] map[数学:map[1000:92] 语文:map[]]
+	// map[1002:map[语文:80]] map[语文:map[1002:80]]
+}
@@ -0,0 +1,446 @@
+package pgcache
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lovego/struct_tag"
+	"github.com/lovego/structs"
+)
+
+// the default number of buckets to verify a table.
+const defaultVerifyBuckets = 64
+
+// VerifyStats is the statistics of the verification of a table.
+type VerifyStats struct {
+	Rounds       int       // the number of rounds verified.
+	Diverged     int       // the total number of rows found diverged and repaired.
+	LastTime     time.Time // the time of the last round.
+	LastDiverged int       // the number of rows diverged in the last round.
+	LastError    string    // the error of the last round.
+}
+
+type verifier struct {
+	stop chan struct{}
+	done chan struct{}
+
+	mutex sync.Mutex
+	stats VerifyStats
+}
+
+// startVerifier starts verifying the table in background if "VerifyInterval" is positive.
+func (t *Table) startVerifier() {
+	if t.VerifyInterval <= 0 || t.verifier != nil {
+		return
+	}
+	v := &verifier{stop: make(chan struct{}), done: make(chan struct{})}
+	t.verifier = v
+	go func() {
+		defer close(v.done)
+		ticker := time.NewTicker(t.VerifyInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-v.stop:
+				return
+			case <-ticker.C:
+				t.Verify()
+			}
+		}
+	}()
+}
+
+// stopVerifier stops the background verifying, and waits for the running round.
+func (t *Table) stopVerifier() {
+	if v := t.verifier; v != nil {
+		close(v.stop)
+		<-v.done
+		t.verifier = nil
+	}
+}
+
+// Verify compares the table rows in db and cache by buckets of "PrimaryKeys", and repairs the
+// buckets which are diverged. It returns the number of diverged rows. Only the buckets whose
+// checksums in db and cache differ are compared row by row. It's called every "VerifyInterval" in
+// background.
+func (t *Table) Verify() (int, error) {
+	if !t.keepRows() {
+		return 0, errors.New("verify: no rows by PrimaryKeys.")
+	}
+	v := t.verifier
+	if v == nil { // called manually, without background verifying.
+		v = &verifier{}
+	}
+	diverged, err := t.verify()
+
+	v.mutex.Lock()
+	v.stats.Rounds++
+	v.stats.Diverged += diverged
+	v.stats.LastTime = time.Now()
+	v.stats.LastDiverged = diverged
+	v.stats.LastError = ""
+	if err != nil {
+		v.stats.LastError = err.Error()
+	}
+	v.mutex.Unlock()
+
+	if err != nil {
+		t.Error(err)
+	}
+	if diverged > 0 {
+		t.Error(fmt.Sprintf("verify: %d rows diverged, repaired.", diverged))
+	}
+	return diverged, err
+}
+
+func (t *Table) verify() (int, error) {
+	dbSums, err := t.dbBucketSums()
+	if err != nil {
+		return 0, err
+	}
+	cacheSums := t.cacheBucketSums()
+
+	var diverged []int
+	for bucket := range dbSums {
+		if dbSums[bucket] == cacheSums[bucket] {
+			continue
+		}
+		rows, err := t.loadBucket(bucket)
+		if err != nil {
+			return 0, err
+		}
+		if t.syncBucket(bucket, rows, false) > 0 {
+			diverged = append(diverged, bucket)
+		}
+	}
+	if len(diverged) == 0 {
+		return 0, nil
+	}
+	// the notifications may fall behind db a little, so the diverged buckets are loaded and
+	// compared again before repairing.
+	time.Sleep(verifyRecheckDelay)
+	var count int
+	for _, bucket := range diverged {
+		rows, err := t.loadBucket(bucket)
+		if err != nil {
+			return count, err
+		}
+		count += t.syncBucket(bucket, rows, true)
+	}
+	return count, nil
+}
+
+var verifyRecheckDelay = time.Second
+
+func (t *Table) loadBucket(bucket int) (reflect.Value, error) {
+	var rows = reflect.New(reflect.SliceOf(t.rowStruct)).Elem()
+	if err := t.dbQuerier.Query(rows.Addr().Interface(), fmt.Sprintf(
+		"SELECT * FROM (%s) AS t WHERE %s = %d", t.LoadSql, t.bucketSql(), bucket,
+	)); err != nil {
+		return rows, fmt.Errorf("verify: %v", err)
+	}
+	return rows, nil
+}
+
+// syncBucket returns the number of rows diverged in the bucket, and repairs them if repair is true.
+func (t *Table) syncBucket(bucket int, rows reflect.Value, repair bool) int {
+	var dbRows = make(map[interface{}]reflect.Value, rows.Len())
+	for i := 0; i < rows.Len(); i++ {
+		row := rows.Index(i)
+		dbRows[t.primaryKey(row)] = row
+	}
+
+	var changes []Change
+	t.datasMutex.RLock()
+	t.rowsMutex.Lock()
+	var unlock = func() {}
+	if repair {
+		unlock = t.lockDatas()
+	}
+	var diverged int
+	for key, row := range t.rows {
+		if t.bucket(row) != bucket {
+			continue
+		}
+		if dbRow, ok := dbRows[key]; !ok {
+			diverged++
+			if repair {
+				t.removeRow(row, true)
+				changes = append(changes, Change{Action: "DELETE", Old: row.Interface()})
+			}
+		} else if t.checksumText(dbRow) != t.checksumText(row) {
+			diverged++
+			if repair {
+				t.saveRow(dbRow, true)
+				changes = append(changes, Change{Action: "UPDATE", Old: row.Interface(), New: dbRow.Interface()})
+			}
+		}
+	}
+	for key, dbRow := range dbRows {
+		if _, ok := t.rows[key]; !ok {
+			diverged++
+			if repair {
+				t.saveRow(dbRow, true)
+				changes = append(changes, Change{Action: "INSERT", New: dbRow.Interface()})
+			}
+		}
+	}
+	unlock()
+	t.rowsMutex.Unlock()
+	t.datasMutex.RUnlock()
+
+	t.publish(changes...)
+	return diverged
+}
+
+// dbBucketSums returns the checksums of the buckets in db.
+func (t *Table) dbBucketSums() ([]string, error) {
+	var sums []struct {
+		Bucket int
+		Sum    string
+	}
+	if err := t.dbQuerier.Query(&sums, fmt.Sprintf(
+		"SELECT %s AS bucket, %s AS sum FROM (%s) AS t GROUP BY 1",
+		t.bucketSql(), t.checksumSql(), t.LoadSql,
+	)); err != nil {
+		return nil, fmt.Errorf("verify: %v", err)
+	}
+	var result = make([]string, t.verifyBuckets())
+	for _, sum := range sums {
+		if sum.Bucket >= 0 && sum.Bucket < len(result) {
+			result[sum.Bucket] = sum.Sum
+		}
+	}
+	return result, nil
+}
+
+// cacheBucketSums returns the checksums of the buckets in cache, which are comparable with the
+// checksums in db.
+func (t *Table) cacheBucketSums() []string {
+	var counts = make([]int, t.verifyBuckets())
+	var sums = make([]uint64, len(counts))
+	t.rowsMutex.Lock()
+	for _, row := range t.rows {
+		bucket := t.bucket(row)
+		hash := md5.Sum([]byte(t.checksumText(row)))
+		counts[bucket]++
+		sums[bucket] += uint64(binary.BigEndian.Uint32(hash[:4]))
+	}
+	t.rowsMutex.Unlock()
+
+	var result = make([]string, len(counts))
+	for i := range result {
+		if counts[i] > 0 {
+			result[i] = fmt.Sprintf("%d:%d", counts[i], sums[i])
+		}
+	}
+	return result
+}
+
+// checksumSql returns the sql expression of the checksum of rows, which is the same as the
+// checksum in cacheBucketSums: the count and the sum of the md5 of checksumText.
+func (t *Table) checksumSql() string {
+	return fmt.Sprintf(
+		"count(*) || ':' || coalesce(sum(('x' || lpad(substr(md5(concat_ws(',', %s)), 1, 8), 16, '0'))"+
+			"::bit(64)::bigint), 0)",
+		strings.Join(t.checksumColumns, ", "),
+	)
+}
+
+// checksumText returns the canonical text of a row to compute its checksum, which is the same as
+// the text of the checksum columns joined by "," in db.
+func (t *Table) checksumText(row reflect.Value) string {
+	var values = make([]string, len(t.checksumFields))
+	for i, name := range t.checksumFields {
+		values[i] = checksumValue(row.FieldByName(name))
+	}
+	return strings.Join(values, ",")
+}
+
+// checksumValue returns the canonical text of a field, see checksumColumn.
+func checksumValue(field reflect.Value) string {
+	if field.Kind() == reflect.Ptr {
+		if field.IsNil() {
+			return `\N`
+		}
+		field = field.Elem()
+	}
+	if field.Type() == timeType {
+		return strconv.FormatInt(field.Interface().(time.Time).UnixMicro(), 10)
+	}
+	switch field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(field.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(field.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return formatFloat(field.Float())
+	case reflect.Bool:
+		return strconv.FormatBool(field.Bool())
+	default:
+		return field.String()
+	}
+}
+
+// checksumColumn returns the sql expression of the canonical text of a column, which is the same
+// as checksumValue of the field in go, or false if the field type can't be checked. Time is
+// compared by unix microseconds, so the time zones don't matter.
+func checksumColumn(column string, typ reflect.Type) (string, bool) {
+	// the text of NULL, it's the text of the zero value in go if the field is not a pointer.
+	var null string
+	if typ.Kind() == reflect.Ptr {
+		typ, null = typ.Elem(), `\N`
+	}
+	var expr, zero string
+	switch typ.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		expr, zero = "t."+column+"::text", "0"
+	case reflect.Float32:
+		expr, zero = "t."+column+"::float4::float8::text", "0"
+	case reflect.Float64:
+		expr, zero = "t."+column+"::float8::text", "0"
+	case reflect.Bool:
+		expr, zero = "t."+column+"::text", "false"
+	case reflect.String:
+		expr = "t." + column + "::text"
+	case reflect.Struct:
+		if typ != timeType {
+			return "", false
+		}
+		expr = "round(extract(epoch from t." + column + ") * 1000000)::bigint::text"
+		zero = checksumValue(reflect.ValueOf(time.Time{}))
+	default:
+		return "", false
+	}
+	if null == "" {
+		null = zero
+	}
+	return fmt.Sprintf("coalesce(%s, '%s')", expr, null), true
+}
+
+// formatFloat formats a float as the float8 output of postgresql 12+: the shortest text which
+// reads back exactly, in exponent form if the exponent is less than -4 or not less than 15.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	s := strconv.FormatFloat(f, 'e', -1, 64)
+	if exp, _ := strconv.Atoi(s[strings.IndexByte(s, 'e')+1:]); exp < -4 || exp >= 15 {
+		return s
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// initChecksumFields finds the loaded fields to compute the checksums of rows, and returns an
+// error if some of them can't be checked.
+func (t *Table) initChecksumFields() error {
+	var loaded = make(map[string]bool)
+	for _, column := range strings.Split(t.Columns+","+t.BigColumns, ",") {
+		loaded[strings.TrimSpace(column)] = true
+	}
+	t.checksumFields, t.checksumColumns = nil, nil
+	var err error
+	structs.TraverseType(t.rowStruct, func(field reflect.StructField) bool {
+		return struct_tag.Get(string(field.Tag), `json`) == "-"
+	}, func(field reflect.StructField) {
+		column := Field2Column(field.Name)
+		if err != nil || !loaded[column] && !loaded["*"] {
+			return
+		}
+		expr, ok := checksumColumn(column, field.Type)
+		if !ok {
+			err = fmt.Errorf(
+				"VerifyInterval: field %s of type %s can't be verified.", field.Name, field.Type,
+			)
+			return
+		}
+		t.checksumFields = append(t.checksumFields, field.Name)
+		t.checksumColumns = append(t.checksumColumns, expr)
+	})
+	return err
+}
+
+// bucketSql returns the sql expression of the bucket of a row, which is the same as Table.bucket.
+func (t *Table) bucketSql() string {
+	return fmt.Sprintf(
+		"('x' || lpad(substr(md5(concat_ws(',', %s)), 1, 8), 16, '0'))::bit(64)::bigint %% %d",
+		t.primaryKeyColumns, t.verifyBuckets(),
+	)
+}
+
+// bucket returns the bucket of a row by "PrimaryKeys".
+func (t *Table) bucket(row reflect.Value) int {
+	var values = make([]string, len(t.PrimaryKeys))
+	for i, name := range t.PrimaryKeys {
+		values[i] = fmt.Sprint(row.FieldByName(name).Interface())
+	}
+	hash := md5.Sum([]byte(strings.Join(values, ",")))
+	return int(binary.BigEndian.Uint32(hash[:4]) % uint32(t.verifyBuckets()))
+}
+
+func (t *Table) verifyBuckets() int {
+	if t.VerifyBuckets > 0 {
+		return t.VerifyBuckets
+	}
+	return defaultVerifyBuckets
+}
+
+// checkVerifyKeys checks that "PrimaryKeys" are integers or strings, whose text in db is the same
+// as in go, so the buckets can be computed both in db and go.
+func (t *Table) checkVerifyKeys() error {
+	for _, name := range t.PrimaryKeys {
+		field, _ := t.rowStruct.FieldByName(name)
+		switch field.Type.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.String:
+		default:
+			return fmt.Errorf(
+				"PrimaryKeys: %s, should be a integer or string type to verify the table.", name,
+			)
+		}
+	}
+	return nil
+}
+
+// VerifyStats returns the statistics of the verification.
+func (t *Table) VerifyStats() VerifyStats {
+	if v := t.verifier; v != nil {
+		v.mutex.Lock()
+		defer v.mutex.Unlock()
+		return v.stats
+	}
+	return VerifyStats{}
+}
+
+// VerifyStatus returns a description of the verification for the manage page.
+func (t *Table) VerifyStatus() string {
+	if t.verifier == nil {
+		return ""
+	}
+	stats := t.VerifyStats()
+	if stats.Rounds == 0 {
+		return "not verified yet"
+	}
+	status := fmt.Sprintf("verified %d times, %d rows diverged, last at %s: %d rows diverged",
+		stats.Rounds, stats.Diverged, stats.LastTime.Format("2006-01-02 15:04:05"), stats.LastDiverged,
+	)
+	if stats.LastError != "" {
+		status += ", " + stats.LastError
+	}
+	return status
+}
@@ -0,0 +1,151 @@
+package pgcache
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lovego/logger"
+)
+
+type verifyQuerier struct {
+	rows []Score
+	// the table to compute the checksums and buckets as db does.
+	table *Table
+	// the number of buckets loaded.
+	loads int
+}
+
+func (q *verifyQuerier) Query(data interface{}, sql string, args ...interface{}) error {
+	if strings.Contains(sql, "GROUP BY") { // the checksums of buckets
+		t := &Table{rowStruct: q.table.rowStruct, rows: make(map[interface{}]reflect.Value),
+			PrimaryKeys: q.table.PrimaryKeys, primaryKeyType: q.table.primaryKeyType,
+			VerifyBuckets: q.table.VerifyBuckets, checksumFields: q.table.checksumFields,
+		}
+		for _, row := range q.rows {
+			rowV := reflect.ValueOf(row)
+			t.rows[t.primaryKey(rowV)] = rowV
+		}
+		sums := reflect.ValueOf(data).Elem()
+		for bucket, checksum := range t.cacheBucketSums() {
+			if checksum != "" {
+				sum := reflect.New(sums.Type().Elem()).Elem()
+				sum.Field(0).SetInt(int64(bucket))
+				sum.Field(1).SetString(checksum)
+				sums.Set(reflect.Append(sums, sum))
+			}
+		}
+		return nil
+	}
+	var rows []Score
+	var bucket = -1
+	if q.table != nil {
+		fmt.Sscanf(sql[strings.LastIndex(sql, "=")+1:], "%d", &bucket)
+		q.loads++
+	}
+	for _, row := range q.rows {
+		if bucket < 0 || q.table.bucket(reflect.ValueOf(row)) == bucket {
+			rows = append(rows, row)
+		}
+	}
+	*data.(*[]Score) = rows
+	return nil
+}
+
+func (q *verifyQuerier) GetDB() *sql.DB {
+	return nil
+}
+
+func ExampleTable_Verify() {
+	verifyRecheckDelay = 0
+	defer func() { verifyRecheckDelay = time.Second }()
+
+	var m map[int]map[string]int
+	var mutex sync.RWMutex
+	t := &Table{
+		Name: "scores", RowStruct: Score{}, PrimaryKeys: []string{"StudentId", "Subject"},
+		VerifyInterval: time.Hour, VerifyBuckets: 4,
+		Datas: []*Data{
+			{RWMutex: &mutex, DataPtr: &m, MapKeys: []string{"StudentId", "Subject"}, Value: "Score"},
+		},
+	}
+	querier := &verifyQuerier{rows: []Score{{StudentId: 1000, Subject: "语文", Score: 90}}}
+	// the diverged rows are logged.
+	if err := t.init("db", querier, logger.New(io.Discard)); err != nil {
+		panic(err)
+	}
+	t.Init("")
+	querier.table = t
+	fmt.Println(t.checksumFields, t.checksumSql())
+	// no bucket is loaded, since the checksums are the same.
+	fmt.Println(t.Verify())
+	fmt.Println(querier.loads)
+
+	// the notifications are missed.
+	querier.rows = []Score{
+		{StudentId: 1000, Subject: "语文", Score: 95}, {StudentId: 1001, Subject: "数学", Score: 80},
+	}
+	t.Create("", []byte(`{"StudentId": 1002, "Subject": "语文", "Score": 70}`))
+	querier.loads = 0
+	fmt.Println(t.Verify())
+	fmt.Println(querier.loads)
+	fmt.Println(m)
+	fmt.Println(t.Verify())
+
+	// Output:
+	// [StudentId Subject Score] count(*) || ':' || coalesce(sum(('x' || lpad(substr(md5(concat_ws(',', coalesce(t.student_id::text, '0'), coalesce(t.subject::text, ''), coalesce(t.score::text, '0'))), 1, 8), 16, '0'))::bit(64)::bigint), 0)
+	// 0 <nil>
+	// 0
+	// 3 <nil>
+	// 6
+	// map[1000:map[语文:95] 1001:map[数学:80] 1002:map[]]
+	// 0 <nil>
+}
+
+func ExampleTable_bucket() {
+	t := &Table{
+		PrimaryKeys: []string{"StudentId", "Subject"}, primaryKeyColumns: "student_id,subject",
+		VerifyBuckets: 64,
+	}
+	fmt.Println(t.bucket(reflect.ValueOf(Score{StudentId: 1000, Subject: "语文"})))
+	fmt.Println(t.bucketSql())
+	// Output:
+	// 27
+	// ('x' || lpad(substr(md5(concat_ws(',', student_id,subject)), 1, 8), 16, '0'))::bit(64)::bigint % 64
+}
+
+func Example_checksumColumn() {
+	type Row struct {
+		Id      int64
+		Price   float64
+		Deleted *bool
+		Time    time.Time
+		Tags    []string
+	}
+	t := &Table{Columns: "id,price,deleted,time", rowStruct: reflect.TypeOf(Row{})}
+	fmt.Println(t.initChecksumFields(), t.checksumFields)
+	for _, column := range t.checksumColumns {
+		fmt.Println(column)
+	}
+	// the time is compared by unix microseconds, whatever the time zone is.
+	zone := time.FixedZone("", 8*3600)
+	row := Row{Id: 1, Price: 1.5e15, Time: time.Date(2026, 1, 2, 11, 4, 5, 6000, zone)}
+	fmt.Println(t.checksumText(reflect.ValueOf(row)))
+	fmt.Println(formatFloat(0.0001), formatFloat(0.00001), formatFloat(123456789012345), formatFloat(-0.5))
+
+	t.Columns = "*"
+	fmt.Println(t.initChecksumFields())
+	// Output:
+	// <nil> [Id Price Deleted Time]
+	// coalesce(t.id::text, '0')
+	// coalesce(t.price::float8::text, '0')
+	// coalesce(t.deleted::text, '\N')
+	// coalesce(round(extract(epoch from t.time) * 1000000)::bigint::text, '-62135596800000000')
+	// 1,1.5e+15,\N,1767323045000006
+	// 0.0001 1e-05 123456789012345 -0.5
+	// VerifyInterval: field Tags of type []string can't be verified.
+}